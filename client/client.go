@@ -2,9 +2,18 @@ package main
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"wire"
 )
 
 var osNewLine string = "\r\n"
@@ -14,71 +23,41 @@ func main() {
 	fmt.Println("##################")
 	fmt.Println("##### CLIENT #####")
 	fmt.Println("##################")
-	// Listen
-	host := "localhost"
-
-	portOptions := os.Args[2:]
-	var listener net.Listener
-	var err error
-	found := false
-	var localPort string = ""
-	// Find a port that is available to listen on
-	for _, localPort = range portOptions {
-		listener, err = net.Listen("tcp", host+":"+localPort)
-		if err != nil {
-			continue
-		} else {
-			found = true
-			break
-		}
-	}
-	if !found {
-		fmt.Println("Could not get a port")
-		os.Exit(-1)
-	}
-
-	fmt.Print("Listening on port ", localPort, "\n\n\n")
-	defer listener.Close()
 
-	// Connect to datacenter and tell it your address that you listen on
-	datacenterAddress := "localhost"
-	datacenterPort := os.Args[1]
-	datacenterConn, err := net.Dial("tcp", datacenterAddress+":"+datacenterPort)
-	if err != nil {
-		fmt.Println("Error, couldn't connect to datacenter", err)
-		os.Exit(-1)
-	}
-
-	// Send DS your listening address
-	dsWriter := bufio.NewWriter(datacenterConn)
-	_, err = dsWriter.WriteString("client\n")
-	if err != nil {
-		fmt.Println("Couldn't write to datacenter", err)
-		os.Exit(-1)
+	// The identity file holds who this client is and the clock of the last message it
+	// sent, so that the datacenter keeps numbering messages from there after a reconnect
+	identityPath := flag.String("identity", "client.id", "file that stores this client's identity")
+	guarantees := flag.String("guarantees", "ryw,mr,wfr,mw", "session guarantees to ask for (comma separated: ryw read your writes, mr monotonic reads, wfr writes follow reads, mw monotonic writes) or none")
+	failover := flag.String("failover", "", "comma separated ports of datacenters to move on to when the connection breaks")
+	flag.Parse()
+	if *guarantees != "none" {
+		for _, name := range strings.Split(*guarantees, ",") {
+			if name != "ryw" && name != "mr" && name != "wfr" && name != "mw" {
+				fmt.Println("Unknown session guarantee", name)
+				os.Exit(-1)
+			}
+		}
 	}
-	_, err = dsWriter.WriteString(host + ":" + localPort + "\n")
+	clientID, lastClock, err := loadIdentity(*identityPath)
 	if err != nil {
-		fmt.Println("Couldn't write to datacenter", err)
+		fmt.Println("Couldn't load client identity", err)
 		os.Exit(-1)
 	}
+	fmt.Println("Client identity:", clientID)
+	clock := &clockKeeper{path: *identityPath, clientID: clientID, lastClock: lastClock}
 
-	if dsWriter.Flush() != nil {
-		fmt.Println("Couldn't flush", err)
-		os.Exit(-1)
-	}
-
-	fmt.Println("Waiting for datacenter connection...")
-	dsListen, err := listener.Accept()
-	if err != nil {
-		fmt.Println("Couldn't accept DS connection", err)
-		os.Exit(-1)
+	// The client starts with the first datacenter and moves on to the next one whenever
+	// the connection breaks, taking its session token along
+	datacenterAddress := "localhost"
+	datacenterPorts := []string{flag.Arg(0)}
+	if *failover != "" {
+		datacenterPorts = append(datacenterPorts, strings.Split(*failover, ",")...)
 	}
-	dsReader := bufio.NewReader(dsListen)
+	session := &datacenterSession{guarantees: *guarantees}
 
 	// This is the loop, just wait for input and send it to the datacenter
 	go func() {
 		reader := bufio.NewReader(os.Stdin)
-		fmt.Println("Ready to go, start chatting")
 		for {
 			text, err := reader.ReadString('\n')
 			// Remove new line characters
@@ -90,28 +69,232 @@ func main() {
 			} else {
 				// Remove read delimiter
 				text = text[:len(text)-1]
-				// add send delimiter
-				_, err := dsWriter.WriteString(text + "\n")
-				if err != nil {
-					fmt.Println("Couldn't write message to datacenter", err)
-				}
-				if dsWriter.Flush() != nil {
-					fmt.Println("Couldn't flush", err)
+				// Record the clocks before sending so that a crash or a failover can
+				// never lead to the same clock being used twice
+				if err := clock.reserve(clocksFor(text)); err != nil {
+					fmt.Println("Couldn't save client identity", err)
 					os.Exit(-1)
 				}
+				if err := session.send(text); err != nil {
+					fmt.Println("Couldn't write message to datacenter", err)
+				}
 			}
 		}
 	}()
 
-	// This is where we deal with incoming messages from the datacenter. The datacenter
-	// takes care of dependencies etc.
-	for {
-		msg, err := dsReader.ReadString('\n')
+	for attempt := 0; ; attempt++ {
+		// Once every datacenter has been tried, wait a bit before trying them again
+		if attempt > 0 && attempt%len(datacenterPorts) == 0 {
+			time.Sleep(retryPause)
+		}
+		datacenter := datacenterAddress + ":" + datacenterPorts[attempt%len(datacenterPorts)]
+		dsReader, err := session.connect(datacenter, clientID, clock.last())
 		if err != nil {
-			fmt.Println("Couldn't read message from datacenter", err)
-			os.Exit(-1)
+			fmt.Println("Error, couldn't connect to datacenter", datacenter, err)
+			continue
+		}
+		fmt.Println("Connected to datacenter", datacenter)
+		fmt.Println("Ready to go, start chatting")
+		fmt.Println("(or use the store: /put <key> <value>, /get <key>, /gettx <key> <key>..., /puttx <key>=<value>...)")
+		fmt.Println("(or shared objects: /gcounter, /pncounter, /orset, /register, /seq <name> <operation>)")
+		fmt.Println("(/stable shows what every datacenter has applied, /status how the linked ones are doing)")
+
+		// This is where we deal with incoming messages from the datacenter. The datacenter
+		// takes care of dependencies etc.
+		for {
+			kind, msg, err := wire.ReadFrame(dsReader)
+			if err != nil {
+				fmt.Println("Couldn't read message from datacenter", err)
+				break
+			}
+			// The datacenter reports the clocks it used up, they are normally reserved
+			// already
+			if kind == wire.Clock {
+				usedClock, err := strconv.Atoi(string(msg))
+				if err == nil {
+					err = clock.advance(usedClock)
+				}
+				if err != nil {
+					fmt.Println("Couldn't record clock from datacenter", err)
+				}
+				continue
+			}
+			if kind == wire.Session {
+				session.setToken(string(msg))
+				continue
+			}
+			fmt.Println(renderMessage(kind, string(msg)))
+		}
+		session.disconnect()
+		// Failing over starts with the next datacenter
+		attempt = attempt % len(datacenterPorts)
+	}
+}
+
+// How long to wait before trying every datacenter again
+const retryPause = 2 * time.Second
+
+// The connection to the current datacenter and the session token: what the client has
+// seen and written, as the datacenter last reported it. The token goes to the next
+// datacenter, which then doesn't let the session go back in time. The input loop
+// sends through the connection while the main loop replaces it, so access is guarded
+// by the mutex
+type datacenterSession struct {
+	sync.Mutex
+	// Both nil while not connected
+	conn   net.Conn
+	writer *bufio.Writer
+	token  string
+	// The session guarantees the client asks every datacenter for
+	guarantees string
+}
+
+// Connects to the datacenter, agrees on the protocol version and tells it who the
+// client is, its session token and the guarantees it wants. The datacenter answers
+// over the same connection, returns a reader for what it sends back
+func (session *datacenterSession) connect(datacenter string, clientID string, lastClock int) (*bufio.Reader, error) {
+	conn, err := net.Dial("tcp", datacenter)
+	if err != nil {
+		return nil, err
+	}
+	session.Lock()
+	defer session.Unlock()
+	identity := clientID + " " + fmt.Sprint(lastClock)
+	if session.token != "" {
+		identity += " " + session.token
+	}
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	err = func() error {
+		if _, err := wire.Handshake(reader, writer, "client"); err != nil {
+			return err
+		}
+		if err := wire.WriteFrame(writer, wire.Identity, []byte(identity)); err != nil {
+			return err
 		}
-		msg = msg[:len(msg)-1]
-		fmt.Println(msg)
+		return wire.WriteFrame(writer, wire.Guarantees, []byte(session.guarantees))
+	}()
+	if err != nil {
+		conn.Close()
+		return nil, err
 	}
+	session.conn = conn
+	session.writer = writer
+	return reader, nil
+}
+
+// Sends a line to the datacenter
+func (session *datacenterSession) send(line string) error {
+	session.Lock()
+	defer session.Unlock()
+	if session.writer == nil {
+		return fmt.Errorf("not connected, the line was dropped")
+	}
+	return wire.WriteFrame(session.writer, wire.Command, []byte(line))
+}
+
+func (session *datacenterSession) setToken(token string) {
+	session.Lock()
+	defer session.Unlock()
+	session.token = token
+}
+
+func (session *datacenterSession) disconnect() {
+	session.Lock()
+	defer session.Unlock()
+	if session.writer == nil {
+		return
+	}
+	session.conn.Close()
+	session.conn = nil
+	session.writer = nil
+}
+
+// Messages that are concurrent with something already on screen are shown in a second
+// column so they can be told apart from causal replies
+func renderMessage(kind wire.Type, body string) string {
+	if kind == wire.Concurrent {
+		return "\t\u2016 " + body
+	}
+	if kind == wire.Failure {
+		return "error: " + body
+	}
+	return body
+}
+
+// Keeps track of the clock of the last message this client sent and persists it.
+// The input loop reserves a clock before sending each line while the datacenter
+// reports the clocks it actually used, so access is guarded by the mutex
+type clockKeeper struct {
+	sync.Mutex
+	path      string
+	clientID  string
+	lastClock int
+}
+
+// The clock of the last message this client sent
+func (keeper *clockKeeper) last() int {
+	keeper.Lock()
+	defer keeper.Unlock()
+	return keeper.lastClock
+}
+
+// Reserves count clocks for the next line
+func (keeper *clockKeeper) reserve(count int) error {
+	keeper.Lock()
+	defer keeper.Unlock()
+	keeper.lastClock += count
+	return saveIdentity(keeper.path, keeper.clientID, keeper.lastClock)
+}
+
+// Records that the datacenter used clocks up to usedClock
+func (keeper *clockKeeper) advance(usedClock int) error {
+	keeper.Lock()
+	defer keeper.Unlock()
+	if usedClock <= keeper.lastClock {
+		return nil
+	}
+	keeper.lastClock = usedClock
+	return saveIdentity(keeper.path, keeper.clientID, keeper.lastClock)
+}
+
+// How many clocks the datacenter may use up for line: one per write of a transaction
+// (a malformed one uses fewer), one for anything else
+func clocksFor(line string) int {
+	fields := strings.Fields(line)
+	if len(fields) > 1 && fields[0] == "/puttx" {
+		return len(fields) - 1
+	}
+	return 1
+}
+
+// Reads the client id and last used clock from the identity file, generating a new
+// identity if the file doesn't exist yet. A clock of -1 means no message was sent
+func loadIdentity(path string) (string, int, error) {
+	contents, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		idBytes := make([]byte, 8)
+		if _, err := rand.Read(idBytes); err != nil {
+			return "", 0, err
+		}
+		clientID := hex.EncodeToString(idBytes)
+		return clientID, -1, saveIdentity(path, clientID, -1)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	fields := strings.Fields(string(contents))
+	if len(fields) != 2 {
+		return "", 0, fmt.Errorf("malformed identity file %s", path)
+	}
+	lastClock, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, fmt.Errorf("malformed clock in identity file %s: %w", path, err)
+	}
+	return fields[0], lastClock, nil
+}
+
+// Writes the client id and last used clock to the identity file
+func saveIdentity(path string, clientID string, lastClock int) error {
+	return os.WriteFile(path, []byte(clientID+"\n"+fmt.Sprint(lastClock)+"\n"), 0644)
 }
@@ -1,3 +1,7 @@
 module client
 
 go 1.17
+
+require wire v0.0.0
+
+replace wire => ../wire
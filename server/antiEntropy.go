@@ -0,0 +1,173 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"time"
+
+	"wire"
+)
+
+// Anti-entropy repairs what the live links missed (a link that was down for long, a
+// datacenter that lost messages in flight when it crashed). Every so often each
+// datacenter opens a session with every one it is linked to: both sides summarize
+// the messages their broker has seen as a version vector (and the holes in it) and
+// send each other whatever the other's summary doesn't include. Messages received this
+// way go through the broker like any message from another datacenter, duplicates are
+// dropped there
+type antiEntropyDigest struct {
+	From string `json:",omitempty"`
+	// What the sender's broker has seen
+	Have VectorClock
+	// The messages Have includes that the sender's broker hasn't seen
+	Lacks []MessageID `json:",omitempty"`
+	// What the sender has that the receiver's summary doesn't include, in causal order
+	Missing []MessageFull `json:",omitempty"`
+}
+
+// Asks the broker for a digest of its history, with the messages theirs doesn't
+// include (none if theirs is nil)
+type antiEntropyRequest struct {
+	theirs *antiEntropyDigest
+	reply  chan antiEntropyDigest
+}
+
+// How long a session may take before it is given up
+const antiEntropyTimeout = 30 * time.Second
+
+func requestDigest(digestRequests chan<- antiEntropyRequest, theirs *antiEntropyDigest) antiEntropyDigest {
+	reply := make(chan antiEntropyDigest)
+	digestRequests <- antiEntropyRequest{theirs: theirs, reply: reply}
+	return <-reply
+}
+
+// Returns a function that hands messages received through anti-entropy with the
+// datacenter from to the broker. They are treated like messages from that datacenter,
+// so they are only passed on to other datacenters if the broker relays. Every
+// datacenter gets one registration with the broker, the first time messages come
+// from it, and every session with it reuses that
+func antiEntropyInjector(registrationChannel chan<- Registration) func(from string, messages []MessageFull) {
+	type query struct {
+		from  string
+		reply chan chan<- MessageFull
+	}
+	queries := make(chan query)
+
+	go func() {
+		registered := map[string]chan<- MessageFull{}
+		for q := range queries {
+			toBroker, found := registered[q.from]
+			if !found {
+				channel := make(chan MessageFull, 100)
+				registrationChannel <- Registration{
+					toBroker:     channel,
+					isDatacenter: true,
+					datacenter:   q.from,
+				}
+				toBroker = channel
+				registered[q.from] = toBroker
+			}
+			q.reply <- toBroker
+		}
+	}()
+
+	return func(from string, messages []MessageFull) {
+		if len(messages) == 0 {
+			return
+		}
+		reply := make(chan chan<- MessageFull)
+		queries <- query{from: from, reply: reply}
+		toBroker := <-reply
+		for _, message := range messages {
+			toBroker <- message
+		}
+	}
+}
+
+// Starts a session with the datacenter at remote every interval, until stop is closed
+func antiEntropy(remote string, local string, interval time.Duration, inject func(string, []MessageFull), digestRequests chan<- antiEntropyRequest, stop <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stop:
+			return
+		case <-ticker.C:
+		}
+		received, sent, err := antiEntropySession(remote, local, inject, digestRequests)
+		if err != nil {
+			fmt.Println("Anti-entropy with", remote, "failed:", err)
+			continue
+		}
+		if received > 0 || sent > 0 {
+			fmt.Println("Anti-entropy with", remote, "received", received, "and sent", sent, "missing messages")
+		}
+	}
+}
+
+// One session, started by this datacenter: it sends its digest, gets back the other's
+// along with what it misses, then sends what the other misses
+func antiEntropySession(remote string, local string, inject func(string, []MessageFull), digestRequests chan<- antiEntropyRequest) (int, int, error) {
+	conn, err := net.DialTimeout("tcp", remote, antiEntropyTimeout)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(antiEntropyTimeout))
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+
+	ours := requestDigest(digestRequests, nil)
+	ours.From = local
+	if _, err := wire.Handshake(reader, writer, "antientropy"); err != nil {
+		return 0, 0, err
+	}
+	if err := writeDigest(writer, ours); err != nil {
+		return 0, 0, err
+	}
+	theirs, err := readDigest(reader)
+	if err != nil {
+		return 0, 0, err
+	}
+	inject(remote, theirs.Missing)
+
+	reply := requestDigest(digestRequests, &theirs)
+	if err := writeDigest(writer, antiEntropyDigest{Have: reply.Have, Missing: reply.Missing}); err != nil {
+		return len(theirs.Missing), 0, err
+	}
+	return len(theirs.Missing), len(reply.Missing), nil
+}
+
+// Answers a session started by another datacenter
+func antiEntropyIncoming(conn net.Conn, reader *bufio.Reader, inject func(string, []MessageFull), digestRequests chan<- antiEntropyRequest) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(antiEntropyTimeout))
+	writer := bufio.NewWriter(conn)
+
+	theirs, err := readDigest(reader)
+	if err != nil {
+		fmt.Println("Bad anti-entropy digest", err)
+		return
+	}
+	ours := requestDigest(digestRequests, &theirs)
+	if err := writeDigest(writer, ours); err != nil {
+		fmt.Println("Anti-entropy with", theirs.From, "failed:", err)
+		return
+	}
+	missing, err := readDigest(reader)
+	if err != nil {
+		fmt.Println("Anti-entropy with", theirs.From, "failed:", err)
+		return
+	}
+	inject(theirs.From, missing.Missing)
+}
+
+func writeDigest(writer *bufio.Writer, digest antiEntropyDigest) error {
+	return wire.WriteJSON(writer, wire.Digest, digest)
+}
+
+func readDigest(reader *bufio.Reader) (antiEntropyDigest, error) {
+	var digest antiEntropyDigest
+	return digest, wire.ReadJSON(reader, wire.Digest, &digest)
+}
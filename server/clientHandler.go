@@ -2,29 +2,61 @@ package main
 
 import (
 	"bufio"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
 	"log"
 	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"wire"
 )
 
 // Registers a client newly connected on conn
-func registerClient(conn net.Conn, reader *bufio.Reader, registrationChannel chan Registration) {
+func registerClient(conn net.Conn, reader *bufio.Reader, registrationChannel chan Registration, storeReads chan<- kvRead, staging stagingConfig, wal *writeAheadLog, subscribeStability func() chan stabilityUpdate, peerHealthList func() []peerHealth, consistency consistencyMode) {
+
+	log.Println("Client connected from", conn.RemoteAddr())
 
-	clientListenAddressPort, err := reader.ReadString('\n')
+	// The client tells us who it is and the clock of the last message it sent (in
+	// any session) so that MessageIDs stay unique across reconnects. A client that
+	// fails over from another datacenter also brings its session token
+	clientID, lastClock, token, err := readClientIdentity(reader)
+	if err != nil {
+		fmt.Println("Bad client identity:", err.Error())
+		conn.Close()
+		return
+	}
+	log.Println("Client identifies as", clientID, "last clock", lastClock, "session", token.ToString())
+	// Then it says which session guarantees it wants
+	asked, err := readSessionGuarantees(reader)
 	if err != nil {
-		fmt.Println("Client left.")
+		fmt.Println("Bad session guarantees:", err.Error())
 		conn.Close()
 		return
 	}
-	// Remove delimiter
-	clientListenAddressPort = clientListenAddressPort[:len(clientListenAddressPort)-1]
+	// What it gets depends on the datacenter's consistency mode
+	guarantees, ordered := consistency.sessionGuarantees(asked)
+	log.Println("Client asks for session guarantees", asked, "and gets", guarantees, "in", consistency, "mode")
+	staging.ignoreDependencies = !ordered
+	staging.writerOrder = ordered
 
-	log.Println("Client connected that listens on " + clientListenAddressPort)
+	// Whatever the client had seen in an earlier session (possibly before this
+	// datacenter crashed) is still seen, so it isn't delivered again. The log may know
+	// of later messages from the client than the client itself does
+	restored := wal.clientState(clientID)
+	if own := restored.Get(clientID); own > lastClock {
+		log.Println("Client's last clock is", own, "according to the log")
+		lastClock = own
+	}
+	restored.Merge(token)
 
-	// Call the client for outgoing communications
-	outGoingConn, err := net.Dial("tcp", clientListenAddressPort)
-	if err != nil {
-		fmt.Println("Error connecting to client:", err.Error())
+	// Nothing happens in the session until this datacenter has applied everything
+	// the client has seen or written elsewhere. Everything goes back to the client over
+	// the connection it opened, so it works from behind NAT
+	if err := catchUpWithSession(conn, guarantees.readContext(token, clientID), subscribeStability()); err != nil {
+		fmt.Println("Turning client", clientID, "away:", err)
 		conn.Close()
 		return
 	}
@@ -33,243 +65,499 @@ func registerClient(conn net.Conn, reader *bufio.Reader, registrationChannel cha
 	localFromBroker := make(chan MessageFull, 100)
 	localToBroker := make(chan MessageFull, 100)
 
+	// The broker replays the conversation so far before any live messages so
+	// that a latecomer can satisfy the dependencies of what follows. What was
+	// compacted away from it is stable, the client starts out having seen it
+	replayBase := make(chan VectorClock)
 	registrationChannel <- Registration{
-		toBroker:   localToBroker,
-		fromBroker: localFromBroker,
+		toBroker:      localToBroker,
+		fromBroker:    localFromBroker,
+		replayHistory: true,
+		replayBase:    replayBase,
 	}
+	restored.Merge(<-replayBase)
+
+	// Closed by the client listener when the connection closes, everything else
+	// serving the client stops then
+	done := make(chan struct{})
 
 	// The client state manager creates channels and state managers
 	// which are accessible via the csSubscribeFn and csUpdateFn
 	// csSubscribeFn: generates a channel that will spit out updates to state
 	// csUpdateFn: takes in a MessageID and updates the state accordingly
-	csSubscribeFn, csUpdateFn := clientSateManager()
+	csSubscribeFn, csUpdateFn := clientSateManager(restored, done)
+	// Everything the client sees is logged before its state moves on
+	logAndUpdateCS := func(id MessageID) {
+		wal.logSeen(clientID, id)
+		csUpdateFn(id)
+	}
 
 	// A simple channle for the client listener to communicate to the
 	// add dependency function
 	clientToLocal := make(chan MessageBasic, 100)
 
 	// Basic function that listens for messages from the client
-	go clientListener(conn, reader, clientToLocal)
-
-	// Adds client dependencies based on client state, also updates
-	// client state for outgoing messages
-	go addDeps(clientToLocal, csSubscribeFn(), csUpdateFn, localToBroker)
+	go clientListener(conn, reader, clientID, lastClock+1, clientToLocal, done)
 
 	// Outgoing messages to the client. messagesReady is a channel to communicate
 	// messages between the staging area and the sending process
-	messagesReady := make(chan MessageBasic, 100)
+	messagesReady := make(chan MessageFull, 100)
+
+	// Adds client dependencies based on client state, also updates
+	// client state for outgoing messages. Reads go to the store and their
+	// answers straight to the sender. Only the nearest dependencies go on to the
+	// broker, the rest is implied
+	withDeps := make(chan MessageFull, 100)
+	go addDeps(clientID, guarantees, clientToLocal, csSubscribeFn(), logAndUpdateCS, withDeps, storeReads, messagesReady, subscribeStability(), peerHealthList, done)
+	go attachNearest(storeReads, withDeps, localToBroker)
 	// This is where messages are staged, awaiting for any dependencies to arrive
-	go clientStaging(localFromBroker, csSubscribeFn(), messagesReady)
-	// Simple function that sends a message over the connection
-	go clientSender(outGoingConn, messagesReady, csUpdateFn)
+	go clientStaging(clientID, staging, localFromBroker, csSubscribeFn(), messagesReady, done)
+	// Simple function that sends a message over the connection, flagging the ones that
+	// are concurrent with what the client has already seen
+	go clientSender(conn, clientID, messagesReady, csSubscribeFn(), logAndUpdateCS, storeReads, ordered, done)
+
+	// Once the client is gone the broker stops sending it messages (staging drains
+	// them until then), otherwise they would pile up and hold up every other endpoint
+	go func() {
+		<-done
+		fmt.Println("Client", clientID, "left")
+		registrationChannel <- Registration{fromBroker: localFromBroker, unregister: true}
+	}()
 }
 
 // This builds a client state management system, returning a tuple of methods to operate
 // on the system. The first of the tuple is a function that generates a channel
 // that is subscribed to updates of the client state. The second function receives a messageID
 // which will then generate a new state based on the messageID. This should be called
-// whenever the client sees a new message
-func clientSateManager() (func() chan ClientState, func(MessageID)) {
+// whenever the client sees a new message. The state starts out as initial, and the first
+// thing a new subscriber receives is the current state. The manager stops once done is
+// closed (nil never closes)
+func clientSateManager(initial VectorClock, done <-chan struct{}) (func() chan VectorClock, func(MessageID)) {
 	// This channel is for updating the client state based on new IDs
 	newIDChan := make(chan MessageID, 100)
 	// This channel is the core channel for distributing state changes
 	// Other "subscription" channels will branch off of this
-	clientStateChan := make(chan ClientState, 100)
+	clientStateChan := make(chan VectorClock, 100)
 
 	// This is an autonomous function that will run in the background,
 	// that is the core state tracker. It ingests newIDChan and
 	// pushes new states onto clientStateChan
 	go func() {
-		clientState := ClientState{}
-		for newID := range newIDChan {
-			found := false
-			// Find out if the new clock is relevant to any clocks
-			// of the current state
-			for i, oldID := range clientState {
-				if newID.Host == oldID.Host {
-					found = true
-					// .. and update the clock if the new one is
-					// more recent (it should always be so, but just in
-					// case)
-					if newID.Clock > oldID.Clock {
-						clientState[i] = newID
-					} else {
-						fmt.Println("State already newer, no need to update state")
-					}
-					break
-				}
+		clientState := initial.Copy()
+		for {
+			var newID MessageID
+			select {
+			case newID = <-newIDChan:
+			case <-done:
+				return
+			}
+			// The state only ever moves forward (it should always do so, but just
+			// in case)
+			if clientState.Includes(newID) {
+				fmt.Println("State already newer, no need to update state")
+				continue
 			}
-			if !found {
-				clientState = append(clientState, newID)
+			clientState.Witness(newID)
+			// Subscribers get their own copy, the map keeps changing here
+			select {
+			case clientStateChan <- clientState.Copy():
+			case <-done:
+				return
 			}
-			// This is a new clock (i.e., the client has a
-			// dependency relevant to a new other client's message)
-			clientStateChan <- clientState
 		}
 	}()
 
 	// This is a returned function for updating the client state. An operator
 	// will just pass it a new MessageID and it will update the state
-	updateClientState := func(newID MessageID) {
-		newIDChan <- newID
+	updateVectorClock := func(newID MessageID) {
+		select {
+		case newIDChan <- newID:
+		case <-done:
+		}
 	}
 
 	// addSubscriber is a bookkeeping channel to add new subscribers to the client
 	// state channel (fanout paradigm). It is only used internally
-	addSubscriber := make(chan chan ClientState, 5)
+	addSubscriber := make(chan chan VectorClock, 5)
 
 	// This is a background function that does the fanout operation, keeping track of
 	// every subscriber based on the addSubscriber channel and sending them updates
-	// to the clientStateChan channel
+	// to the clientStateChan channel. A state includes every earlier one, so a
+	// subscriber only ever gets the latest: one it hasn't received yet is replaced by
+	// the next. That way a subscriber that is busy (staging releasing a long cascade
+	// to the store, which updates this very state) never holds the manager up
 	go func() {
-		subscribers := []chan ClientState{}
+		subscribers := []chan VectorClock{}
+		latest := initial.Copy()
+		publish := func(subscriber chan VectorClock) {
+			select {
+			case <-subscriber:
+			default:
+			}
+			subscriber <- latest.Copy()
+		}
 		for {
 			select {
 			case newSub := <-addSubscriber:
+				publish(newSub)
 				subscribers = append(subscribers, newSub)
 			case newState := <-clientStateChan:
+				latest = newState
 				for _, subscriber := range subscribers {
-					subscriber <- newState
+					publish(subscriber)
 				}
+			case <-done:
+				return
 			}
 		}
 	}()
 
 	// This is a returned utility function for generating a new subscriber and returning
 	// the relevant fanout channel
-	csSubscribeFn := func() chan ClientState {
-		localCSChan := make(chan ClientState, cap(clientStateChan))
+	csSubscribeFn := func() chan VectorClock {
+		localCSChan := make(chan VectorClock, 1)
 		addSubscriber <- localCSChan
 		return localCSChan
 	}
-	return csSubscribeFn, updateClientState
+	return csSubscribeFn, updateVectorClock
 }
 
 // This function ingests MessageBasic items - ie those received from the client
-// and applies dependencies based on the client's current state. It will also
-// update the client state based on the messages that are sent
-func addDeps(msgsIn <-chan MessageBasic, clientStateChan <-chan ClientState, updateCS func(MessageID), msgsOut chan<- MessageFull) {
-	clientState := ClientState{}
+// and applies dependencies based on the client's current state (as much of it as
+// the client's session guarantees ask for). It will also update the client state
+// based on the messages that are sent. Reads are answered by the store (once it has
+// caught up with the client's state) and the answer is sent to the client through
+// replies, as are the stable frontier and the health of the linked datacenters (only
+// until done is closed, the sender is gone then). Lines the client sent are still
+// passed on after that, msgsOut is closed once the listener has closed msgsIn
+func addDeps(clientID string, guarantees sessionGuarantees, msgsIn <-chan MessageBasic, clientStateChan <-chan VectorClock, updateCS func(MessageID), msgsOut chan<- MessageFull, storeReads chan<- kvRead, replies chan<- MessageFull, stability <-chan stabilityUpdate, peerHealthList func() []peerHealth, done <-chan struct{}) {
+	clientState := <-clientStateChan
+	stable := VectorClock{}
+	// The sender may be gone already
+	reply := func(message MessageFull) {
+		select {
+		case replies <- message:
+		case <-done:
+		}
+	}
 	for {
 		select {
-		case message := <-msgsIn:
-			csCopy := append(ClientState{}, clientState...)
-			msgsOut <- MessageFull{
+		case message, open := <-msgsIn:
+			if !open {
+				close(msgsOut)
+				return
+			}
+			if message.Kind == ErrorMessage {
+				// A command that didn't parse, only its sender hears of it
+				reply(MessageFull{MessageBasic: message})
+				continue
+			}
+			if message.Kind == StableMessage {
+				reply(MessageFull{MessageBasic: MessageBasic{Kind: StableMessage, Body: []byte(stable.ToString())}})
+				continue
+			}
+			if message.Kind == StatusMessage {
+				lines := []string{}
+				for _, health := range peerHealthList() {
+					lines = append(lines, health.ToString())
+				}
+				reply(MessageFull{MessageBasic: MessageBasic{Kind: StatusMessage, Body: []byte(strings.Join(lines, "\n"))}})
+				continue
+			}
+			if message.Kind == GetMessage || message.Kind == GetTxMessage {
+				// Reads are synchronous, the client's next operation must see
+				// what it read
+				var versions []Version
+				context := guarantees.readContext(clientState, clientID)
+				if message.Kind == GetMessage {
+					versions = storeRead(storeReads, []string{message.Key}, context, nil)
+				} else {
+					versions = readTransaction(storeReads, strings.Fields(string(message.Body)), context)
+				}
+				for _, version := range versions {
+					if version.ID.Host != "" {
+						clientState.Witness(version.ID)
+					}
+					// What was read depends on more than the version itself: an object
+					// folds in every operation the store has applied, concurrent ones
+					// included. The client has seen all of that now
+					for host, clock := range version.Dependencies {
+						if id := (MessageID{Host: host, Clock: clock}); !clientState.Includes(id) {
+							clientState.Witness(id)
+							updateCS(id)
+						}
+					}
+					reply(MessageFull{
+						MessageBasic: MessageBasic{ID: version.ID, Kind: ValueMessage, Key: version.Key, Body: version.Value},
+						Dependencies: version.Dependencies,
+					})
+				}
+				continue
+			}
+			dependencies := guarantees.writeDependencies(clientState, clientID)
+			if message.Kind == CrdtMessage {
+				// The operation is prepared against the store's copy of the object,
+				// and the operation may refer to anything the store had seen, so it
+				// depends on that whatever the guarantees
+				prepared, visible, err := prepareCrdtOp(storeReads, message, guarantees.readContext(clientState, clientID))
+				if err != nil {
+					fmt.Println("Couldn't prepare", message.ToString(), err)
+					reply(MessageFull{MessageBasic: MessageBasic{Kind: ErrorMessage, Key: message.Key, Body: []byte(err.Error())}})
+					continue
+				}
+				clientState.Merge(visible)
+				dependencies.Merge(visible)
+				message = prepared
+			}
+			outgoing := MessageFull{
 				MessageBasic: message,
-				Dependencies: csCopy,
+				Dependencies: dependencies,
+				Lamport:      clientState.Count() + 1,
 			}
-			updateCS(message.ID)
-		case clientState = <-clientStateChan:
+			if previous, found := clientState[clientID]; found && !guarantees.monotonicWrites {
+				outgoing.Follows = &MessageID{Host: clientID, Clock: previous}
+			}
+			msgsOut <- outgoing
+			// Witness our own message right away so that the next one depends on it
+			// even if the state manager hasn't caught up yet. The writes of a
+			// transaction must not depend on each other (they are only visible
+			// together), so it is witnessed after its last write
+			if message.isLastPart() {
+				clientState.Witness(message.ID)
+				updateCS(message.ID)
+			}
+		case cs := <-clientStateChan:
+			// Updates may lag behind what we witnessed locally, merging never
+			// moves the state backwards
+			clientState.Merge(cs)
+		case update := <-stability:
+			stable = update.Stable
 		}
 	}
 }
 
-// Ingests messages over the socket from the client and posts them on the messageChannel
-func clientListener(conn net.Conn, reader *bufio.Reader, messageChannel chan<- MessageBasic) {
-	clientID := conn.RemoteAddr().String()[10:]
-	defer conn.Close()
-
-	// messageCounter is used as a lambart clock for how many messages this client has received
-	// it is also the identifier for the message
-	messageCounter := 0
-
-	for {
-		msgBody, err := reader.ReadString('\n')
-		if err != nil {
-			fmt.Println("Error receiving message from client", err)
-			return
-		}
-		// Remove delimiter
-		msgBody = msgBody[:len(msgBody)-1]
-		message := MessageBasic{
-			ID: MessageID{
-				Host:  clientID,
-				Clock: messageCounter,
-			},
-			Body: []byte(msgBody),
+// Reads the "<client id> <last clock> [<session token>]" identity the client starts with
+func readClientIdentity(reader *bufio.Reader) (string, int, VectorClock, error) {
+	payload, err := wire.Expect(reader, wire.Identity)
+	if err != nil {
+		return "", 0, nil, err
+	}
+	identity := string(payload)
+	fields := strings.Fields(identity)
+	if len(fields) != 2 && len(fields) != 3 {
+		return "", 0, nil, fmt.Errorf("expected \"<id> <clock> [<session token>]\", got %q", identity)
+	}
+	if !validClientID(fields[0]) {
+		return "", 0, nil, fmt.Errorf("invalid client id %q", fields[0])
+	}
+	lastClock, err := strconv.Atoi(fields[1])
+	if err != nil {
+		return "", 0, nil, fmt.Errorf("invalid clock %q: %w", fields[1], err)
+	}
+	token := VectorClock{}
+	if len(fields) == 3 {
+		if err := json.Unmarshal([]byte(fields[2]), &token); err != nil {
+			return "", 0, nil, fmt.Errorf("invalid session token %q: %w", fields[2], err)
 		}
-		fmt.Println("Received message from client:", message.ToString())
-		messageChannel <- message
-		messageCounter++
 	}
+	return fields[0], lastClock, token, nil
 }
 
-// Determines if a messageID's dependencies are satisfied
-func dependenciesSatisfied(dependencies []MessageID, seen ClientState) bool {
-	for _, dependency := range dependencies {
-		found := false
-		for _, stateDatum := range seen {
-			if stateDatum.Host == dependency.Host && stateDatum.Clock >= dependency.Clock {
-				found = true
-				break
-			}
-		}
-		if !found {
-			fmt.Println("Dependency not satisfied!\nState: ", seen.ToString(), ". Missing: "+dependency.ToString())
-			return false
-		}
+// Clients pick their own ids, 8 random bytes in hex. Ids end up in the log, in
+// messages and in vector clocks, so nothing else is accepted
+func validClientID(id string) bool {
+	if len(id) != 16 {
+		return false
 	}
-	return true
+	_, err := hex.DecodeString(id)
+	return err == nil
 }
 
-func clientStaging(availableMessages <-chan MessageFull, clientStateChan <-chan ClientState, messagesReady chan<- MessageBasic) {
-	clientState := ClientState{}
-	queuedMessages := []MessageFull{}
+// Reads the session guarantees the client asks for, after its identity
+func readSessionGuarantees(reader *bufio.Reader) (sessionGuarantees, error) {
+	payload, err := wire.Expect(reader, wire.Guarantees)
+	if err != nil {
+		return sessionGuarantees{}, err
+	}
+	return parseGuarantees(string(payload))
+}
 
-	trySendingMessage := func(message MessageFull) bool {
-		if dependenciesSatisfied(message.Dependencies, clientState) {
-			messagesReady <- message.MessageBasic
-			return true
-		} else {
-			fmt.Println("... for message:", message.ToString())
-		}
-		return false
+// How long a datacenter may take to catch up with the session of a client that
+// failed over to it before the client is sent on to another one
+const sessionCatchUpTimeout = time.Minute
+
+// Waits until this datacenter has applied what the client's session token says it saw
+// and wrote at other datacenters (as much of it as its reads wait for), so that its
+// reads never go back in time. The client is told while it waits
+func catchUpWithSession(conn net.Conn, token VectorClock, stability <-chan stabilityUpdate) error {
+	update := <-stability
+	if update.Applied.Dominates(token) {
+		return nil
 	}
-	trySendingMessages := func() {
-		newMessages := []MessageFull{}
-		for _, message := range queuedMessages {
-			if !trySendingMessage(message) {
-				newMessages = append(newMessages, message)
-			}
+	writer := bufio.NewWriter(conn)
+	if err := writeClientFrame(writer, wire.Value, "waiting for this datacenter to catch up with your session..."); err != nil {
+		return err
+	}
+	timeout := time.NewTimer(sessionCatchUpTimeout)
+	defer timeout.Stop()
+	for !update.Applied.Dominates(token) {
+		select {
+		case update = <-stability:
+		case <-timeout.C:
+			writeClientFrame(writer, wire.Failure, "session: this datacenter couldn't catch up with your session")
+			return fmt.Errorf("didn't catch up with session %s", token.ToString())
 		}
-		queuedMessages = newMessages
 	}
+	return writeClientFrame(writer, wire.Value, "caught up with your session")
+}
+
+// Ingests messages over the socket from the client and posts them on the messageChannel.
+// Messages are numbered starting at firstClock
+// When the connection closes, the messageChannel is closed and then done
+func clientListener(conn net.Conn, reader *bufio.Reader, clientID string, firstClock int, messageChannel chan<- MessageBasic, done chan<- struct{}) {
+	defer close(done)
+	defer close(messageChannel)
+	defer conn.Close()
+
+	// The clock of the last message this client sent, incremented to identify the next
+	// one. It continues from the client's previous session
+	sent := VectorClock{clientID: firstClock - 1}
 
 	for {
-		select {
-		case message := <-availableMessages:
-			fmt.Println("Staging-new message: ", message.ToString())
-			if !trySendingMessage(message) {
-				queuedMessages = append(queuedMessages, message)
+		msgBody, err := wire.Expect(reader, wire.Command)
+		if err != nil {
+			fmt.Println("Error receiving message from client", err)
+			return
+		}
+		for _, message := range parseClientLine(string(msgBody)) {
+			// Only what is replicated needs an identifier
+			if message.Kind.isReplicated() {
+				message.ID = sent.Increment(clientID)
+				// A transaction is identified by its first write
+				if message.Tx != nil && message.Tx.ID.Host == "" {
+					message.Tx.ID = message.ID
+				}
 			}
-		case cs := <-clientStateChan:
-			fmt.Println("Staging-New state: ", cs.ToString())
-			clientState = append(ClientState{}, cs...)
-			trySendingMessages()
+			fmt.Println("Received message from client:", message.ToString())
+			messageChannel <- message
 		}
 	}
 }
 
 // This function just sends messages
-func clientSender(conn net.Conn, messages <-chan MessageBasic, updateState func(MessageID)) {
-	// I control the connection, so close it when I'm done
+func clientSender(conn net.Conn, clientID string, messages <-chan MessageFull, clientStateChan <-chan VectorClock, updateState func(MessageID), storeReads chan<- kvRead, ordered bool, done <-chan struct{}) {
+	// The listener reads from the same connection, whichever of the two stops first
+	// closes it so that the other one stops too
 	defer conn.Close()
 	writer := bufio.NewWriter(conn)
 
+	// Everything the client has shown, including its own messages (these come through
+	// the state updates). Deliveries are witnessed here right away as state updates lag
+	shown := <-clientStateChan
+	// The last session token sent
+	token := VectorClock{}
+
 	// Wait for new messages to come in to the messageChannel
-	for message := range messages {
-		fmt.Println("Sending message to client: " + message.ToString())
-		_, err := writer.Write(append(message.Body, '\n'))
-		if err != nil {
-			fmt.Println(err)
+	for {
+		select {
+		case <-done:
 			return
-		}
-
-		if writer.Flush() != nil {
-			fmt.Println("Couldn't flush", err)
-		} else {
+		case cs := <-clientStateChan:
+			// The client's own messages show up in its state once they are sent
+			if cs.Get(clientID) > shown.Get(clientID) {
+				if err := writeClientFrame(writer, wire.Clock, fmt.Sprint(cs.Get(clientID))); err != nil {
+					fmt.Println(err)
+					return
+				}
+			}
+			shown.Merge(cs)
+			if shown.Compare(token) != Equal {
+				token = shown.Copy()
+				encoded, _ := json.Marshal(token)
+				if err := writeClientFrame(writer, wire.Session, string(encoded)); err != nil {
+					fmt.Println(err)
+					return
+				}
+			}
+		case message := <-messages:
+			if message.Kind == ErrorMessage {
+				if err := writeClientFrame(writer, wire.Failure, message.Key+": "+string(message.Body)); err != nil {
+					fmt.Println(err)
+					return
+				}
+				continue
+			}
+			if message.Kind == StableMessage {
+				frontier := string(message.Body)
+				if frontier == "" {
+					frontier = "nothing yet"
+				}
+				if err := writeClientFrame(writer, wire.Value, "stable: "+frontier); err != nil {
+					fmt.Println(err)
+					return
+				}
+				continue
+			}
+			if message.Kind == StatusMessage {
+				peers := strings.Split(string(message.Body), "\n")
+				if len(message.Body) == 0 {
+					peers = []string{"no linked datacenters"}
+				}
+				for _, peer := range peers {
+					if err := writeClientFrame(writer, wire.Value, "peer "+peer); err != nil {
+						fmt.Println(err)
+						return
+					}
+				}
+				continue
+			}
+			// Writes to the store are not shown but the client has seen them, so
+			// anything that depends on them can be delivered
+			if message.Kind == PutMessage || message.Kind == CrdtMessage {
+				shown.Witness(message.ID)
+				updateState(message.ID)
+				continue
+			}
+			if message.Kind == ValueMessage {
+				line := message.Key + " = " + string(message.Body)
+				if message.ID.Host == "" {
+					line = message.Key + " is not set"
+				}
+				if err := writeClientFrame(writer, wire.Value, line); err != nil {
+					fmt.Println(err)
+					return
+				}
+				if message.ID.Host != "" {
+					shown.Witness(message.ID)
+					updateState(message.ID)
+				}
+				continue
+			}
+			// Messages are delivered in causal order so nothing shown can come after
+			// this message. If its causal past doesn't cover all that was shown, the
+			// rest is concurrent with it. It only carries its nearest dependencies,
+			// so the store expands them. A client that isn't delivered messages in
+			// order doesn't wait for the store to commit them either, what the store
+			// can't expand yet counts as concurrent
+			kind := wire.Causal
+			if !expandDependencies(storeReads, message.Dependencies, ordered).Dominates(shown) {
+				kind = wire.Concurrent
+				fmt.Println("Message", message.ID.ToString(), "is concurrent with some of", shown.ToString())
+			}
+			fmt.Println("Sending message to client: " + message.MessageBasic.ToString())
+			if err := writeClientFrame(writer, kind, string(message.Body)); err != nil {
+				fmt.Println(err)
+				return
+			}
 			// Let everyone know it has been sent
+			shown.Witness(message.ID)
 			updateState(message.ID)
 		}
 	}
 }
+
+// Sends the client a frame of the given type, what it holds is shown to the user (see
+// wire for the types)
+func writeClientFrame(writer *bufio.Writer, kind wire.Type, body string) error {
+	return wire.WriteFrame(writer, kind, []byte(body))
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// Lines the listener read before the connection closed are still passed on, however
+// many are queued when done is closed
+func TestAddDepsPassesOnQueuedLines(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		queued int
+	}{
+		{"nothing queued", 0},
+		{"one line", 1},
+		{"full queue", 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			client := "0123456789abcdef"
+			done := make(chan struct{})
+			csSubscribeFn, csUpdateFn := clientSateManager(VectorClock{}, nil)
+			msgsIn := make(chan MessageBasic, 100)
+			msgsOut := make(chan MessageFull, 100)
+			for clock := 1; clock <= tc.queued; clock++ {
+				msgsIn <- MessageBasic{ID: MessageID{Host: client, Clock: clock}, Kind: ChatMessage, Body: []byte("hi")}
+			}
+			// As the listener does when the connection closes
+			close(msgsIn)
+			close(done)
+			go addDeps(client, sessionGuarantees{}, msgsIn, csSubscribeFn(), csUpdateFn, msgsOut, nil, nil, nil, nil, done)
+
+			passed := 0
+			for {
+				select {
+				case _, open := <-msgsOut:
+					if !open {
+						if passed != tc.queued {
+							t.Fatalf("passed on %d lines, want %d", passed, tc.queued)
+						}
+						return
+					}
+					passed++
+				case <-time.After(5 * time.Second):
+					t.Fatalf("msgsOut was never closed, %d lines passed on", passed)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+)
+
+// Clients are plain terminals, so anything that isn't a chat line is typed as a
+// slash command:
+//
+//	/put <key> <value>   writes value to key
+//	/get <key>           reads key
+//	/gettx <key> <key>... reads a causally consistent snapshot of several keys
+//	/puttx <key>=<value>... writes several keys so they become visible together
+//	/gcounter <name> inc [amount]
+//	/pncounter <name> inc|dec [amount]
+//	/orset <name> add|remove <element>
+//	/register <name> set <value>
+//	/seq <name> append <value> | insert <index> <value> | delete <index>
+//	                     operate on CRDT objects, which are read with /get
+//	/stable              shows what every datacenter has applied
+//	/status              shows the health of the datacenters this one links to
+//
+// Anything else (including unknown commands) is a line of chat. A line usually
+// becomes one message, a transaction becomes one per write. A transaction or CRDT
+// command that doesn't parse becomes an error for the client instead, so a typo isn't
+// replicated to everyone as chat
+func parseClientLine(line string) []MessageBasic {
+	chat := []MessageBasic{{Kind: ChatMessage, Body: []byte(line)}}
+	failure := func(command string, usage string) []MessageBasic {
+		return []MessageBasic{{Kind: ErrorMessage, Key: command, Body: []byte("usage: " + usage)}}
+	}
+	fields := strings.Fields(line)
+	if len(fields) == 0 || !strings.HasPrefix(fields[0], "/") {
+		return chat
+	}
+	switch {
+	case fields[0] == "/put" && len(fields) >= 3:
+		// The value is the rest of the line, spaces included
+		return []MessageBasic{{Kind: PutMessage, Key: fields[1], Body: []byte(afterFields(line, 2))}}
+	case fields[0] == "/get" && len(fields) == 2:
+		return []MessageBasic{{Kind: GetMessage, Key: fields[1]}}
+	case fields[0] == "/stable" && len(fields) == 1:
+		return []MessageBasic{{Kind: StableMessage}}
+	case fields[0] == "/status" && len(fields) == 1:
+		return []MessageBasic{{Kind: StatusMessage}}
+	case fields[0] == "/gettx" && len(fields) >= 2:
+		return []MessageBasic{{Kind: GetTxMessage, Body: []byte(strings.Join(fields[1:], " "))}}
+	case fields[0] == "/puttx":
+		// The listener numbers the writes and fills in the transaction id
+		tx := &TxInfo{Parts: len(fields) - 1}
+		writes := []MessageBasic{}
+		for _, assignment := range fields[1:] {
+			equals := strings.Index(assignment, "=")
+			if equals <= 0 {
+				break
+			}
+			writes = append(writes, MessageBasic{Kind: PutMessage, Key: assignment[:equals], Body: []byte(assignment[equals+1:]), Tx: tx})
+		}
+		if tx.Parts == 0 || len(writes) != tx.Parts {
+			return failure(fields[0], "/puttx <key>=<value>...")
+		}
+		return writes
+	case crdtUsage[fields[0][1:]] != "":
+		if len(fields) >= 3 {
+			if op, ok := parseCrdtCommand(fields, line); ok {
+				return []MessageBasic{{Kind: CrdtMessage, Key: fields[1], Body: op.encode()}}
+			}
+		}
+		return failure(fields[0], crdtUsage[fields[0][1:]])
+	}
+	return chat
+}
+
+// How each type of CRDT object is operated on, by type
+var crdtUsage = map[string]string{
+	"gcounter":  "/gcounter <name> inc [amount]",
+	"pncounter": "/pncounter <name> inc|dec [amount]",
+	"orset":     "/orset <name> add|remove <element>",
+	"register":  "/register <name> set <value>",
+	"seq":       "/seq <name> append <value> | insert <index> <value> | delete <index>",
+}
+
+// Parses "/<type> <name> <operation> [arguments]" into a CRDT operation
+func parseCrdtCommand(fields []string, line string) (crdtOp, bool) {
+	op := crdtOp{Type: fields[0][1:], Op: fields[2]}
+	// The amount defaults to 1
+	amount := func() bool {
+		op.Amount = 1
+		if len(fields) == 4 {
+			parsed, err := strconv.Atoi(fields[3])
+			op.Amount = parsed
+			return err == nil
+		}
+		return len(fields) == 3
+	}
+	switch op.Type + " " + op.Op {
+	case "gcounter inc", "pncounter inc", "pncounter dec":
+		return op, amount()
+	case "orset add", "orset remove":
+		op.Value = afterFields(line, 3)
+		return op, len(fields) >= 4
+	case "register set":
+		op.Value = afterFields(line, 3)
+		return op, true
+	case "seq append":
+		// Appending is inserting at the end
+		op.Op = "insert"
+		op.Index = -1
+		op.Value = afterFields(line, 3)
+		return op, len(fields) >= 4
+	case "seq insert", "seq delete":
+		if len(fields) < 4 {
+			return op, false
+		}
+		index, err := strconv.Atoi(fields[3])
+		op.Index = index
+		if op.Op == "insert" {
+			op.Value = afterFields(line, 4)
+		}
+		return op, err == nil
+	}
+	return op, false
+}
+
+// Returns what follows the first n whitespace separated fields of line
+func afterFields(line string, n int) string {
+	rest := strings.TrimSpace(line)
+	for i := 0; i < n; i++ {
+		end := strings.IndexFunc(rest, unicode.IsSpace)
+		if end < 0 {
+			return ""
+		}
+		rest = strings.TrimLeftFunc(rest[end:], unicode.IsSpace)
+	}
+	return rest
+}
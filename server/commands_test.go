@@ -0,0 +1,36 @@
+package main
+
+import "testing"
+
+func TestParseClientLine(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		line  string
+		kinds []MessageKind
+	}{
+		{name: "chat", line: "hello there", kinds: []MessageKind{ChatMessage}},
+		{name: "unknown command", line: "/shrug", kinds: []MessageKind{ChatMessage}},
+		{name: "put", line: "/put k some value", kinds: []MessageKind{PutMessage}},
+		{name: "transaction", line: "/puttx a=1 b=2", kinds: []MessageKind{PutMessage, PutMessage}},
+		{name: "transaction without writes", line: "/puttx", kinds: []MessageKind{ErrorMessage}},
+		{name: "transaction with a bad write", line: "/puttx a=1 b", kinds: []MessageKind{ErrorMessage}},
+		{name: "transaction with an empty key", line: "/puttx =1", kinds: []MessageKind{ErrorMessage}},
+		{name: "counter", line: "/pncounter stock dec 3", kinds: []MessageKind{CrdtMessage}},
+		{name: "counter with a bad amount", line: "/pncounter stock dec three", kinds: []MessageKind{ErrorMessage}},
+		{name: "unknown operation", line: "/gcounter visits dec", kinds: []MessageKind{ErrorMessage}},
+		{name: "object without an operation", line: "/orset members", kinds: []MessageKind{ErrorMessage}},
+		{name: "insert without an index", line: "/seq log insert", kinds: []MessageKind{ErrorMessage}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			messages := parseClientLine(tc.line)
+			if len(messages) != len(tc.kinds) {
+				t.Fatalf("got %d messages, want %d", len(messages), len(tc.kinds))
+			}
+			for i, kind := range tc.kinds {
+				if messages[i].Kind != kind {
+					t.Errorf("message %d: got %s, want %s", i, messages[i].Kind, kind)
+				}
+			}
+		})
+	}
+}
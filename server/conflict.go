@@ -0,0 +1,127 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Decides the value of a key when the latest versions written to it are concurrent
+// (neither writer had seen the other's write). Every datacenter must use the same
+// resolver so that they all converge to the same value
+type ConflictResolver interface {
+	// Receives the concurrent versions (at least two, ordered by writtenBefore) and
+	// returns the ones that make up the key's value
+	Resolve(siblings []Version) []Version
+}
+
+// Keeps the version with the highest Lamport timestamp, breaking ties by host id
+type lastWriterWins struct{}
+
+func (lastWriterWins) Resolve(siblings []Version) []Version {
+	return siblings[len(siblings)-1:]
+}
+
+// Keeps every sibling; the client sees all of them and resolves the conflict by
+// writing a new value after reading them (which makes it depend on all of them)
+type multiValue struct{}
+
+func (multiValue) Resolve(siblings []Version) []Version {
+	return siblings
+}
+
+// Lets the application merge the values of siblings. The merged value takes the
+// place of the last writer's version
+type callbackResolver struct {
+	merge func(a, b []byte) []byte
+}
+
+func (resolver callbackResolver) Resolve(siblings []Version) []Version {
+	merged := siblings[0].Value
+	for _, sibling := range siblings[1:] {
+		merged = resolver.merge(merged, sibling.Value)
+	}
+	winner := siblings[len(siblings)-1]
+	winner.Value = merged
+	return []Version{winner}
+}
+
+// Application merge functions that can be selected by name
+var mergeCallbacks = map[string]func(a, b []byte) []byte{
+	// Keeps all the values, comma separated
+	"concat": func(a, b []byte) []byte {
+		return []byte(string(a) + "," + string(b))
+	},
+	// Keeps the value that sorts last
+	"max": func(a, b []byte) []byte {
+		if strings.Compare(string(a), string(b)) >= 0 {
+			return a
+		}
+		return b
+	},
+}
+
+// The names of the mergeCallbacks, for usage messages
+func mergeCallbackNames() string {
+	names := []string{}
+	for name := range mergeCallbacks {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return strings.Join(names, ", ")
+}
+
+// Returns the resolver selected by name: "lww", "multi" or the name of one of the
+// mergeCallbacks
+func newConflictResolver(name string) (ConflictResolver, error) {
+	switch name {
+	case "lww":
+		return lastWriterWins{}, nil
+	case "multi":
+		return multiValue{}, nil
+	}
+	if merge, found := mergeCallbacks[name]; found {
+		return callbackResolver{merge: merge}, nil
+	}
+	return nil, fmt.Errorf("unknown conflict resolver %q", name)
+}
+
+// Orders versions by the Stamps of their writes
+func (v Version) writtenBefore(other Version) bool {
+	return Stamp{Lamport: v.Lamport, ID: v.ID}.before(Stamp{Lamport: other.Lamport, ID: other.ID})
+}
+
+// Returns the versions of a key as of cut (everything if there is no cut): the
+// versions in the cut that no other version in the cut has overwritten, with any
+// conflict between them settled by the resolver. A key without a value gets a
+// Version without an ID
+func versionsAt(key string, versions []Version, cut VectorClock, resolver ConflictResolver) []Version {
+	// Versions are committed in causal order, so a version can only be overwritten by
+	// one committed after it. Overwriting is transitive (dependencies are complete),
+	// so it is enough to check against the latest versions found so far
+	latest := []Version{}
+	for i := len(versions) - 1; i >= 0; i-- {
+		version := versions[i]
+		if cut != nil && !cut.Includes(version.ID) {
+			continue
+		}
+		overwritten := false
+		for _, newer := range latest {
+			if newer.Dependencies.Includes(version.ID) {
+				overwritten = true
+				break
+			}
+		}
+		if !overwritten {
+			latest = append(latest, version)
+		}
+	}
+	switch len(latest) {
+	case 0:
+		return []Version{{Key: key}}
+	case 1:
+		return latest
+	}
+	sort.Slice(latest, func(i, j int) bool { return latest[i].writtenBefore(latest[j]) })
+	return resolver.Resolve(latest)
+}
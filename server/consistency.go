@@ -0,0 +1,44 @@
+package main
+
+import "fmt"
+
+// How much consistency the datacenter gives its clients, picked at startup so that the
+// same workload can be run against each and the anomalies compared. Every datacenter
+// should run in the same mode:
+//
+//	causal    the session guarantees each client asks for (all of them, by default)
+//	fifo      every client's messages are seen in the order they were sent, and a
+//	          client reads its own writes, but nothing else is ordered
+//	eventual  messages are delivered as soon as they arrive and reads don't wait for
+//	          anything; the datacenters still converge
+//
+// The weaker modes are built from the same parts as the session guarantees: in fifo
+// mode a write only depends on the client's own earlier writes, so waiting for
+// dependencies only keeps each client's messages in order
+type consistencyMode string
+
+const (
+	eventualConsistency consistencyMode = "eventual"
+	fifoConsistency     consistencyMode = "fifo"
+	causalConsistency   consistencyMode = "causal"
+)
+
+func parseConsistencyMode(name string) (consistencyMode, error) {
+	mode := consistencyMode(name)
+	if mode != eventualConsistency && mode != fifoConsistency && mode != causalConsistency {
+		return mode, fmt.Errorf("unknown consistency mode %q (known: eventual, fifo, causal)", name)
+	}
+	return mode, nil
+}
+
+// The guarantees a client that asked for asked gets in this mode, and whether messages
+// are only delivered to it once it has seen what they depend on
+func (mode consistencyMode) sessionGuarantees(asked sessionGuarantees) (sessionGuarantees, bool) {
+	switch mode {
+	case eventualConsistency:
+		return sessionGuarantees{}, false
+	case fifoConsistency:
+		return sessionGuarantees{readYourWrites: true, monotonicWrites: true}, true
+	}
+	return asked, asked.monotonicReads
+}
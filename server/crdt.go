@@ -0,0 +1,315 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// A convergent replicated data type. Operations travel as CrdtMessages and every
+// datacenter applies them in causal order (they are staged like any other message),
+// which is all operation-based CRDTs need: concurrent operations commute, so every
+// datacenter ends up with the same value
+type CRDT interface {
+	// Checks the operation and fills in what it refers to in the current state (e.g.
+	// the tags an OR-Set remove takes away). Done once, where the operation starts
+	Prepare(op *crdtOp) error
+	// Applies an operation carried by message
+	Apply(message MessageFull, op crdtOp)
+	// Renders the value for a client
+	Value() string
+}
+
+// An operation on a CRDT, carried in the Body of a CrdtMessage whose Key names the
+// object
+type crdtOp struct {
+	// The type of the object: gcounter, pncounter, orset, register or seq
+	Type   string
+	Op     string
+	Amount int    `json:",omitempty"`
+	Value  string `json:",omitempty"`
+	// A position in a sequence as the client sees it, turned into Refs by Prepare.
+	// -1 is the end
+	Index int `json:",omitempty"`
+	// Ids of the operations this one refers to, filled in by Prepare
+	Refs []MessageID `json:",omitempty"`
+}
+
+func (op crdtOp) encode() []byte {
+	encoded, _ := json.Marshal(op)
+	return encoded
+}
+
+func decodeCrdtOp(body []byte) (crdtOp, error) {
+	var op crdtOp
+	err := json.Unmarshal(body, &op)
+	return op, err
+}
+
+// Creates an empty object of the named type
+func newCRDT(typeName string) (CRDT, error) {
+	switch typeName {
+	case "gcounter":
+		return &gCounter{Counts: map[string]int{}}, nil
+	case "pncounter":
+		return &pnCounter{Increments: map[string]int{}, Decrements: map[string]int{}}, nil
+	case "orset":
+		return &orSet{Tags: map[string][]MessageID{}}, nil
+	case "register":
+		return &lwwRegister{}, nil
+	case "seq":
+		return &rgaSequence{}, nil
+	}
+	return nil, fmt.Errorf("unknown CRDT type %q", typeName)
+}
+
+// Grow-only counter: each host counts its own increments
+type gCounter struct {
+	Counts map[string]int
+}
+
+func (counter *gCounter) Prepare(op *crdtOp) error {
+	if op.Op != "inc" || op.Amount < 0 {
+		return fmt.Errorf("a gcounter can only be incremented")
+	}
+	return nil
+}
+
+func (counter *gCounter) Apply(message MessageFull, op crdtOp) {
+	counter.Counts[message.ID.Host] += op.Amount
+}
+
+func (counter *gCounter) Value() string {
+	total := 0
+	for _, count := range counter.Counts {
+		total += count
+	}
+	return fmt.Sprint(total)
+}
+
+// Counter that can go up and down: a grow-only counter for each direction
+type pnCounter struct {
+	Increments map[string]int
+	Decrements map[string]int
+}
+
+func (counter *pnCounter) Prepare(op *crdtOp) error {
+	if (op.Op != "inc" && op.Op != "dec") || op.Amount < 0 {
+		return fmt.Errorf("a pncounter can only be incremented or decremented")
+	}
+	return nil
+}
+
+func (counter *pnCounter) Apply(message MessageFull, op crdtOp) {
+	if op.Op == "inc" {
+		counter.Increments[message.ID.Host] += op.Amount
+	} else {
+		counter.Decrements[message.ID.Host] += op.Amount
+	}
+}
+
+func (counter *pnCounter) Value() string {
+	total := 0
+	for _, count := range counter.Increments {
+		total += count
+	}
+	for _, count := range counter.Decrements {
+		total -= count
+	}
+	return fmt.Sprint(total)
+}
+
+// Observed-remove set: every add tags the element with its message id and a remove
+// only takes away the tags it has observed, so an add that is concurrent with a
+// remove wins
+type orSet struct {
+	Tags map[string][]MessageID
+}
+
+func (set *orSet) Prepare(op *crdtOp) error {
+	switch op.Op {
+	case "add":
+	case "remove":
+		op.Refs = append([]MessageID{}, set.Tags[op.Value]...)
+	default:
+		return fmt.Errorf("an orset can only add or remove elements")
+	}
+	return nil
+}
+
+func (set *orSet) Apply(message MessageFull, op crdtOp) {
+	if op.Op == "add" {
+		set.Tags[op.Value] = append(set.Tags[op.Value], message.ID)
+		return
+	}
+	removed := map[MessageID]bool{}
+	for _, ref := range op.Refs {
+		removed[ref] = true
+	}
+	remaining := []MessageID{}
+	for _, tag := range set.Tags[op.Value] {
+		if !removed[tag] {
+			remaining = append(remaining, tag)
+		}
+	}
+	if len(remaining) == 0 {
+		delete(set.Tags, op.Value)
+	} else {
+		set.Tags[op.Value] = remaining
+	}
+}
+
+func (set *orSet) Value() string {
+	elements := []string{}
+	for element := range set.Tags {
+		elements = append(elements, element)
+	}
+	sort.Strings(elements)
+	return "{" + strings.Join(elements, ", ") + "}"
+}
+
+// Last-writer-wins register
+type lwwRegister struct {
+	Current string
+	Stamp   Stamp
+}
+
+func (register *lwwRegister) Prepare(op *crdtOp) error {
+	if op.Op != "set" {
+		return fmt.Errorf("a register can only be set")
+	}
+	return nil
+}
+
+func (register *lwwRegister) Apply(message MessageFull, op crdtOp) {
+	if stamp := message.stamp(); register.Stamp.before(stamp) {
+		register.Current = op.Value
+		register.Stamp = stamp
+	}
+}
+
+func (register *lwwRegister) Value() string {
+	return register.Current
+}
+
+// One element of a sequence. Deleted elements stay as tombstones because concurrent
+// inserts may still refer to them
+type rgaElement struct {
+	Stamp   Stamp
+	Value   string
+	Deleted bool
+}
+
+// Replicated growable array: a sequence (e.g. a chat log) where every element is
+// inserted after another one. Elements inserted concurrently after the same one are
+// ordered by their stamps, newest first, so every datacenter builds the same sequence
+type rgaSequence struct {
+	Elements []rgaElement
+}
+
+// Returns the position of the index-th element that isn't deleted, len(Elements) if
+// there aren't that many
+func (sequence *rgaSequence) position(index int) int {
+	for position, element := range sequence.Elements {
+		if element.Deleted {
+			continue
+		}
+		if index == 0 {
+			return position
+		}
+		index--
+	}
+	return len(sequence.Elements)
+}
+
+func (sequence *rgaSequence) Prepare(op *crdtOp) error {
+	switch op.Op {
+	case "insert":
+		// Inserting at index means inserting after the element before it
+		op.Refs = nil
+		if op.Index == -1 {
+			for i := len(sequence.Elements) - 1; i >= 0; i-- {
+				if !sequence.Elements[i].Deleted {
+					op.Refs = []MessageID{sequence.Elements[i].Stamp.ID}
+					break
+				}
+			}
+		} else if op.Index > 0 {
+			position := sequence.position(op.Index - 1)
+			if position == len(sequence.Elements) {
+				return fmt.Errorf("index %d is past the end", op.Index)
+			}
+			op.Refs = []MessageID{sequence.Elements[position].Stamp.ID}
+		}
+	case "delete":
+		position := sequence.position(op.Index)
+		if op.Index < 0 || position == len(sequence.Elements) {
+			return fmt.Errorf("no element at index %d", op.Index)
+		}
+		op.Refs = []MessageID{sequence.Elements[position].Stamp.ID}
+	default:
+		return fmt.Errorf("a seq can only insert or delete elements")
+	}
+	return nil
+}
+
+func (sequence *rgaSequence) find(id MessageID) int {
+	for position, element := range sequence.Elements {
+		if element.Stamp.ID == id {
+			return position
+		}
+	}
+	return -1
+}
+
+func (sequence *rgaSequence) Apply(message MessageFull, op crdtOp) {
+	if op.Op == "delete" {
+		if position := sequence.find(op.Refs[0]); position >= 0 {
+			sequence.Elements[position].Deleted = true
+		}
+		return
+	}
+	element := rgaElement{Stamp: message.stamp(), Value: op.Value}
+	// Right after the anchor (or at the head), then past any newer elements. Those
+	// were inserted concurrently after the same anchor, or after one of them
+	position := 0
+	if len(op.Refs) > 0 {
+		position = sequence.find(op.Refs[0]) + 1
+	}
+	for position < len(sequence.Elements) && element.Stamp.before(sequence.Elements[position].Stamp) {
+		position++
+	}
+	sequence.Elements = append(sequence.Elements, rgaElement{})
+	copy(sequence.Elements[position+1:], sequence.Elements[position:])
+	sequence.Elements[position] = element
+}
+
+func (sequence *rgaSequence) Value() string {
+	values := []string{}
+	for _, element := range sequence.Elements {
+		if !element.Deleted {
+			values = append(values, fmt.Sprintf("%q", element.Value))
+		}
+	}
+	return "[" + strings.Join(values, ", ") + "]"
+}
+
+// Has the store prepare a CRDT operation (carried by message) and returns the
+// prepared message. Preparing reads the object, so the returned context (what was
+// visible at the store) must be added to the client's state: the operation may refer
+// to anything in it
+func prepareCrdtOp(storeReads chan<- kvRead, message MessageBasic, context VectorClock) (MessageBasic, VectorClock, error) {
+	op, err := decodeCrdtOp(message.Body)
+	if err != nil {
+		return message, nil, err
+	}
+	reply := make(chan kvReply)
+	storeReads <- kvRead{keys: []string{message.Key}, context: context, prepare: &op, reply: reply}
+	answer := <-reply
+	if answer.err != nil {
+		return message, nil, answer.err
+	}
+	message.Body = op.encode()
+	return message, answer.visible, nil
+}
@@ -0,0 +1,130 @@
+package main
+
+import "testing"
+
+// Every datacenter applies the operations in some causal order. Whichever it is, the
+// objects end up with the same value
+func TestCRDTConvergence(t *testing.T) {
+	id := func(host string, clock int) MessageID { return MessageID{Host: host, Clock: clock} }
+	operation := func(of MessageID, lamport int, dependencies VectorClock, op crdtOp) MessageFull {
+		return MessageFull{
+			MessageBasic: MessageBasic{ID: of, Kind: CrdtMessage, Key: "object", Body: op.encode()},
+			Dependencies: dependencies,
+			Lamport:      lamport,
+		}
+	}
+	for _, tc := range []struct {
+		name       string
+		typeName   string
+		operations []MessageFull
+		want       string
+	}{
+		{
+			name:     "gcounter",
+			typeName: "gcounter",
+			operations: []MessageFull{
+				operation(id("x", 0), 1, nil, crdtOp{Op: "inc", Amount: 1}),
+				operation(id("y", 0), 1, nil, crdtOp{Op: "inc", Amount: 2}),
+				operation(id("x", 1), 2, VectorClock{"x": 0}, crdtOp{Op: "inc", Amount: 3}),
+			},
+			want: "6",
+		},
+		{
+			name:     "pncounter",
+			typeName: "pncounter",
+			operations: []MessageFull{
+				operation(id("x", 0), 1, nil, crdtOp{Op: "inc", Amount: 5}),
+				operation(id("y", 0), 1, nil, crdtOp{Op: "dec", Amount: 2}),
+				operation(id("z", 0), 2, VectorClock{"y": 0}, crdtOp{Op: "dec", Amount: 1}),
+			},
+			want: "2",
+		},
+		{
+			name:     "orset add wins over a concurrent remove",
+			typeName: "orset",
+			operations: []MessageFull{
+				operation(id("x", 0), 1, nil, crdtOp{Op: "add", Value: "a"}),
+				operation(id("y", 0), 2, VectorClock{"x": 0}, crdtOp{Op: "remove", Value: "a", Refs: []MessageID{id("x", 0)}}),
+				operation(id("z", 0), 1, nil, crdtOp{Op: "add", Value: "a"}),
+				operation(id("x", 1), 2, VectorClock{"x": 0}, crdtOp{Op: "add", Value: "b"}),
+			},
+			want: "{a, b}",
+		},
+		{
+			name:     "orset remove of everything observed",
+			typeName: "orset",
+			operations: []MessageFull{
+				operation(id("x", 0), 1, nil, crdtOp{Op: "add", Value: "a"}),
+				operation(id("y", 0), 1, nil, crdtOp{Op: "add", Value: "a"}),
+				operation(id("z", 0), 2, VectorClock{"x": 0, "y": 0}, crdtOp{Op: "remove", Value: "a", Refs: []MessageID{id("x", 0), id("y", 0)}}),
+			},
+			want: "{}",
+		},
+		{
+			name:     "register",
+			typeName: "register",
+			operations: []MessageFull{
+				operation(id("x", 0), 1, nil, crdtOp{Op: "set", Value: "one"}),
+				// Same timestamp, the host breaks the tie
+				operation(id("y", 0), 1, nil, crdtOp{Op: "set", Value: "two"}),
+				operation(id("x", 1), 2, VectorClock{"x": 0}, crdtOp{Op: "set", Value: "three"}),
+			},
+			want: "three",
+		},
+		{
+			name:     "seq",
+			typeName: "seq",
+			operations: []MessageFull{
+				operation(id("x", 0), 1, nil, crdtOp{Op: "insert", Value: "a"}),
+				// Inserted concurrently after the same element, the newer one goes first
+				operation(id("y", 0), 2, VectorClock{"x": 0}, crdtOp{Op: "insert", Value: "b", Refs: []MessageID{id("x", 0)}}),
+				operation(id("z", 0), 2, VectorClock{"x": 0}, crdtOp{Op: "insert", Value: "c", Refs: []MessageID{id("x", 0)}}),
+				operation(id("z", 1), 3, VectorClock{"x": 0, "z": 0}, crdtOp{Op: "insert", Value: "d", Refs: []MessageID{id("z", 0)}}),
+				operation(id("x", 1), 3, VectorClock{"x": 0, "y": 0}, crdtOp{Op: "delete", Refs: []MessageID{id("y", 0)}}),
+			},
+			want: `["a", "c", "d"]`,
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			orders := 0
+			var apply func(applied VectorClock, order []MessageFull, remaining []MessageFull)
+			apply = func(applied VectorClock, order []MessageFull, remaining []MessageFull) {
+				if len(remaining) == 0 {
+					orders++
+					object, err := newCRDT(tc.typeName)
+					if err != nil {
+						t.Fatal(err)
+					}
+					for _, message := range order {
+						op, err := decodeCrdtOp(message.Body)
+						if err != nil {
+							t.Fatal(err)
+						}
+						object.Apply(message, op)
+					}
+					if got := object.Value(); got != tc.want {
+						ids := []string{}
+						for _, message := range order {
+							ids = append(ids, message.ID.ToString())
+						}
+						t.Fatalf("applied in the order %v: got %s, want %s", ids, got, tc.want)
+					}
+					return
+				}
+				for i, message := range remaining {
+					if !applied.Dominates(message.Dependencies) {
+						continue
+					}
+					next := applied.Copy()
+					next.Witness(message.ID)
+					rest := append(append([]MessageFull{}, remaining[:i]...), remaining[i+1:]...)
+					apply(next, append(order[:len(order):len(order)], message), rest)
+				}
+			}
+			apply(VectorClock{}, nil, tc.operations)
+			if orders < 2 {
+				t.Fatalf("only %d causal orders, the operations should be concurrent", orders)
+			}
+		})
+	}
+}
@@ -2,36 +2,61 @@ package main
 
 import (
 	"bufio"
-	"encoding/json"
 	"fmt"
 	"math/rand"
 	"net"
 	"strconv"
 	"time"
+
+	"wire"
 )
 
 const maxSecondsWait = 10
 
-// Sends message updates from messageChannel to specific datacenter specified by address and port
-// This function is called for each datacenter
-func datacenterOutgoing(address string, port string, registrationChannel chan<- Registration) {
+// Reconnecting to a datacenter waits firstBackoff, doubling with every failed attempt
+// up to maxBackoff
+const (
+	firstBackoff = 500 * time.Millisecond
+	maxBackoff   = 30 * time.Second
+)
 
-	var conn net.Conn
-	var err error
-	backoff := 0
-	for {
-		conn, err = net.Dial("tcp", address+":"+port)
-		if err == nil {
-			break
-		}
-		// Exponential backoff
-		time.Sleep(time.Duration(2^backoff) * time.Second)
-		backoff++
-	}
+// The first line a datacenter link sends after its endpoint type. Sequence numbers
+// are per incarnation: a restarted datacenter numbers its packets from 0 again
+type datacenterHello struct {
+	// The datacenter's address
+	From        string
+	Incarnation string
+	// Datacenters in different consistency modes make for a meaningless comparison
+	Consistency consistencyMode `json:",omitempty"`
+}
+
+// A message on a datacenter link, numbered so the receiving side can acknowledge it
+// and drop duplicates. A packet that carries what the datacenters have Applied and who
+// the Members are (as far as the sender knows) instead isn't numbered, a newer one
+// makes it obsolete. Neither is a Heartbeat, which only asks for an acknowledgement
+type datacenterPacket struct {
+	Seq       int
+	Message   MessageFull
+	Applied   map[string]VectorClock `json:",omitempty"`
+	Members   memberView             `json:",omitempty"`
+	Heartbeat bool                   `json:",omitempty"`
+}
+
+// How often a datacenter tells the others what has been applied and who the members
+// are (if that changed)
+const announceAppliedEvery = time.Second
+
+// Sends message updates from messageChannel to specific datacenter specified by address and port
+// This function is called for each datacenter. Closing stop takes the link down (the
+// datacenter left) and unregisters it from the broker. The health of the other
+// datacenter goes to reportHealth
+func datacenterOutgoing(address string, port string, registrationChannel chan<- Registration, local datacenterHello, stability <-chan stabilityUpdate, members <-chan memberView, stop <-chan struct{}, reportHealth func(string, peerStatus, time.Time)) {
 	sendChannel := make(chan MessageFull, 100)
 	registrationChannel <- Registration{
-		toBroker:   nil,
-		fromBroker: sendChannel,
+		toBroker:     nil,
+		fromBroker:   sendChannel,
+		isDatacenter: true,
+		datacenter:   address + ":" + port,
 	}
 
 	// Add the prtNum to the seed, otherwise it will have the same seed as other threads!
@@ -44,72 +69,418 @@ func datacenterOutgoing(address string, port string, registrationChannel chan<-
 		time.Sleep(time.Duration(waitSeconds) * time.Second)
 	}
 
-	readyMessages := make(chan MessageFull, 100)
-	go datacenterSendMessage(conn, readyMessages)
+	readyGroups := make(chan []MessageFull, 100)
+	go datacenterLink(address+":"+port, local, readyGroups, stability, members, stop, reportHealth)
+	go func() {
+		<-stop
+		registrationChannel <- Registration{fromBroker: sendChannel, unregister: true}
+	}()
+	// The writes of a transaction travel together, after a single delay
+	assemble := txAssembler()
 	// Grab messages that are ready to send, asynchronously delay them for random amount of time
-	// then send them off to the other datacenter
+	// then send them off to the other datacenter. Once stopped, messages are drained
+	// until the broker closes the channel
 	for message := range sendChannel {
+		select {
+		case <-stop:
+			continue
+		default:
+		}
 		fmt.Println("Received message from broker to send to other datacenter: " + message.ToString())
-		go func(message MessageFull) {
+		group := assemble(message)
+		if group == nil {
+			continue
+		}
+		go func(group []MessageFull) {
 			randomDelay(maxSecondsWait)
 			fmt.Println("... delay over, sending.")
-			readyMessages <- message
-		}(message)
+			select {
+			case readyGroups <- group:
+			case <-stop:
+			}
+		}(group)
 	}
 }
 
-// Simple function that just sends the messages
-func datacenterSendMessage(conn net.Conn, readyMessages <-chan MessageFull) {
+// Something that happened on a link's connection: an acknowledgement or an error
+type linkEvent struct {
+	conn net.Conn
+	ack  int
+	err  error
+}
 
-	defer conn.Close()
-	writer := bufio.NewWriter(conn)
-	writer.WriteString("datacenter\n")
+// Keeps the link to the datacenter at remote up and delivers every group of messages
+// at least once, in order. Packets are numbered and kept until the other side
+// acknowledges them. Whenever the connection breaks the link redials (with capped
+// exponential backoff and jitter) and resumes after the last packet the other side
+// has, so nothing is lost in between. The messages of a group get consecutive numbers.
+// The link also keeps the other side up to date with what this datacenter has applied
+// and who the members are, and stops resending messages that have become stable (they
+// got there some other way). Heartbeats tell whether the other side is still there (see
+// health.go). It ends when stop is closed
+func datacenterLink(remote string, local datacenterHello, readyGroups <-chan []MessageFull, stability <-chan stabilityUpdate, members <-chan memberView, stop <-chan struct{}, reportHealth func(string, peerStatus, time.Time)) {
+	rng := rand.New(rand.NewSource(time.Now().UnixNano()))
+	unacknowledged := []datacenterPacket{}
+	nextSeq := 0
+	// What the datacenters have applied, who the members are, and whether the other
+	// side has been told
+	applied := map[string]VectorClock{}
+	view := memberView{}
+	announced := true
+	announceTicker := time.NewTicker(announceAppliedEvery)
+	defer announceTicker.Stop()
+	// When the other side was last heard from (on the current connection)
+	var lastHeard time.Time
+	heartbeatTicker := time.NewTicker(heartbeatEvery)
+	defer heartbeatTicker.Stop()
 
-	if writer.Flush() != nil {
-		fmt.Println("Couldn't flush")
+	var conn net.Conn
+	var writer *bufio.Writer
+	events := make(chan linkEvent, 100)
+	attempts := 0
+	retry := time.NewTimer(0)
+	defer retry.Stop()
+
+	disconnect := func(err error) {
+		fmt.Println("Lost the link to datacenter", remote, err)
+		conn.Close()
+		conn = nil
+		retry.Reset(firstBackoff)
 	}
-	for message := range readyMessages {
-		fmt.Println("Sending message to other datacenter", message.ToString())
-		jsonMsg, err := json.Marshal(message)
-		if err != nil {
-			fmt.Println("Error creating message", message, err)
-		} else {
-			_, err := writer.WriteString(string(jsonMsg) + "\n")
+	// Sends packets from the first one the other side doesn't have yet
+	resend := func() error {
+		for _, packet := range unacknowledged {
+			if err := writePacket(writer, packet); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	for {
+		select {
+		case <-stop:
+			fmt.Println("Link to datacenter", remote, "closed,", len(unacknowledged), "messages undelivered")
+			if conn != nil {
+				conn.Close()
+			}
+			reportHealth(remote, peerLeft, lastHeard)
+			return
+		case group := <-readyGroups:
+			for _, message := range group {
+				packet := datacenterPacket{Seq: nextSeq, Message: message}
+				nextSeq++
+				unacknowledged = append(unacknowledged, packet)
+				if conn == nil {
+					continue
+				}
+				fmt.Println("Sending message to other datacenter", message.ToString())
+				if err := writePacket(writer, packet); err != nil {
+					disconnect(err)
+				}
+			}
+		case event := <-events:
+			if event.err != nil {
+				// Errors of connections that were already replaced don't matter
+				if event.conn == conn {
+					disconnect(event.err)
+				}
+				continue
+			}
+			if event.conn == conn {
+				lastHeard = time.Now()
+			}
+			unacknowledged = acknowledge(unacknowledged, event.ack)
+		case update := <-stability:
+			unacknowledged = dropStable(unacknowledged, update.Stable)
+			applied = update.Known
+			announced = false
+		case view = <-members:
+			announced = false
+		case <-heartbeatTicker.C:
+			if conn == nil {
+				reportHealth(remote, peerDown, lastHeard)
+				continue
+			}
+			status := statusAfter(time.Since(lastHeard))
+			reportHealth(remote, status, lastHeard)
+			if status == peerDown {
+				disconnect(fmt.Errorf("nothing heard for %v", time.Since(lastHeard).Round(time.Millisecond)))
+				continue
+			}
+			if err := writePacket(writer, datacenterPacket{Seq: -1, Heartbeat: true}); err != nil {
+				disconnect(err)
+			}
+		case <-announceTicker.C:
+			if conn == nil || announced || (len(applied) == 0 && len(view) == 0) {
+				continue
+			}
+			if err := writePacket(writer, datacenterPacket{Seq: -1, Applied: applied, Members: view}); err != nil {
+				disconnect(err)
+				continue
+			}
+			announced = true
+		case <-retry.C:
+			var reader *bufio.Reader
+			var resumeAfter int
+			var err error
+			conn, reader, resumeAfter, err = dialDatacenter(remote, local)
 			if err != nil {
-				fmt.Println("Error creating message", message, err)
+				delay := backoff(attempts, rng)
+				attempts++
+				fmt.Println("Couldn't reach datacenter", remote, err, "- retrying in", delay.Round(time.Millisecond))
+				retry.Reset(delay)
+				continue
 			}
-			if writer.Flush() != nil {
-				fmt.Println("Couldn't flush", err)
+			attempts = 0
+			lastHeard = time.Now()
+			// The other side may not know what was applied here or who the members are
+			// (it may have restarted)
+			announced = false
+			writer = bufio.NewWriter(conn)
+			unacknowledged = acknowledge(unacknowledged, resumeAfter)
+			fmt.Println("Linked to datacenter", remote, "resending", len(unacknowledged), "messages")
+			go readAcknowledgements(conn, reader, events)
+			if err := resend(); err != nil {
+				disconnect(err)
 			}
+		}
+	}
+}
+
+// How long to wait before reconnecting after attempts failures: the backoff doubles
+// up to maxBackoff, and a random part of it is taken off so that datacenters don't
+// all retry at the same time
+func backoff(attempts int, rng *rand.Rand) time.Duration {
+	delay := maxBackoff
+	if attempts < 16 && firstBackoff<<attempts < maxBackoff {
+		delay = firstBackoff << attempts
+	}
+	return delay/2 + time.Duration(rng.Int63n(int64(delay/2)+1))
+}
+
+// Drops the packets up to seq, the other side has them
+func acknowledge(packets []datacenterPacket, seq int) []datacenterPacket {
+	for len(packets) > 0 && packets[0].Seq <= seq {
+		packets = packets[1:]
+	}
+	return packets
+}
+
+// Drops the packets whose messages are stable, every datacenter has them
+func dropStable(packets []datacenterPacket, stable VectorClock) []datacenterPacket {
+	kept := []datacenterPacket{}
+	for _, packet := range packets {
+		if !stable.Includes(packet.Message.ID) {
+			kept = append(kept, packet)
+		}
+	}
+	return kept
+}
 
+// Connects to the datacenter at remote and introduces this one. The other side answers
+// with the number of the last packet it got from this incarnation
+func dialDatacenter(remote string, local datacenterHello) (net.Conn, *bufio.Reader, int, error) {
+	conn, err := net.Dial("tcp", remote)
+	if err != nil {
+		return nil, nil, 0, err
+	}
+	// Don't wait forever on a datacenter that accepts but doesn't answer
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	conn.SetReadDeadline(time.Now().Add(maxBackoff))
+	resumeAfter, err := func() (int, error) {
+		if _, err := wire.Handshake(reader, writer, "datacenter"); err != nil {
+			return 0, err
+		}
+		if err := wire.WriteJSON(writer, wire.Introduce, local); err != nil {
+			return 0, err
+		}
+		return readAck(reader)
+	}()
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		conn.Close()
+		return nil, nil, 0, err
+	}
+	return conn, reader, resumeAfter, nil
+}
+
+// Reads the acknowledgements (the number of the last packet received) the other side
+// sends back, until the connection breaks
+func readAcknowledgements(conn net.Conn, reader *bufio.Reader, events chan<- linkEvent) {
+	for {
+		ack, err := readAck(reader)
+		if err != nil {
+			events <- linkEvent{conn: conn, err: err}
+			return
+		}
+		events <- linkEvent{conn: conn, ack: ack}
+	}
+}
+
+func writePacket(writer *bufio.Writer, packet datacenterPacket) error {
+	return wire.WriteJSON(writer, wire.Packet, packet)
+}
+
+func writeAck(writer *bufio.Writer, seq int) error {
+	return wire.WriteFrame(writer, wire.Ack, []byte(fmt.Sprint(seq)))
+}
+
+func readAck(reader *bufio.Reader) (int, error) {
+	payload, err := wire.Expect(reader, wire.Ack)
+	if err != nil {
+		return 0, err
+	}
+	ack, err := strconv.Atoi(string(payload))
+	if err != nil {
+		return 0, fmt.Errorf("bad acknowledgement %q", payload)
+	}
+	return ack, nil
+}
+
+// Returns functions to get and set the number of the last packet delivered from each
+// datacenter incarnation. Links are replaced when they break, so this outlives them.
+// Only the latest incarnation of a datacenter is kept: asking about a new one forgets
+// the old one, whose packets won't come anymore
+func datacenterProgress() (func(datacenter string, incarnation string) int, func(datacenter string, incarnation string, seq int)) {
+	type progress struct {
+		incarnation string
+		seq         int
+	}
+	type update struct {
+		datacenter string
+		progress
+	}
+	type query struct {
+		datacenter  string
+		incarnation string
+		reply       chan int
+	}
+	updates := make(chan update, 100)
+	queries := make(chan query)
+
+	go func() {
+		delivered := map[string]progress{}
+		apply := func(u update) {
+			// A link to an older incarnation may still be winding down
+			if delivered[u.datacenter].incarnation == u.incarnation {
+				delivered[u.datacenter] = u.progress
+			}
+		}
+		for {
+			select {
+			case u := <-updates:
+				apply(u)
+			case q := <-queries:
+				// Updates made before the query are taken into account
+				for pending := true; pending; {
+					select {
+					case u := <-updates:
+						apply(u)
+					default:
+						pending = false
+					}
+				}
+				known, found := delivered[q.datacenter]
+				if !found || known.incarnation != q.incarnation {
+					known = progress{incarnation: q.incarnation, seq: -1}
+					delivered[q.datacenter] = known
+				}
+				q.reply <- known.seq
+			}
 		}
+	}()
+
+	lastDelivered := func(datacenter string, incarnation string) int {
+		reply := make(chan int)
+		queries <- query{datacenter: datacenter, incarnation: incarnation, reply: reply}
+		return <-reply
+	}
+	setDelivered := func(datacenter string, incarnation string, seq int) {
+		updates <- update{datacenter: datacenter, progress: progress{incarnation: incarnation, seq: seq}}
 	}
+	return lastDelivered, setDelivered
 }
 
-// Receives updates from a specific datacenter and sends the result along messagechannel
-func datacenterIncoming(conn net.Conn, reader *bufio.Reader, registrationChannel chan<- Registration) {
+// Receives updates from a specific datacenter and sends the result along messagechannel.
+// Every group of messages handed on is acknowledged, packets that were already
+// delivered (resent because an acknowledgement got lost) are dropped. What the other
+// datacenter says it has applied goes to reportApplied, who it says the members are to
+// members
+func datacenterIncoming(conn net.Conn, reader *bufio.Reader, registrationChannel chan<- Registration, lastDelivered func(string, string) int, setDelivered func(string, string, int), reportApplied func(string, VectorClock), members *membership, consistency consistencyMode) {
+	defer conn.Close()
+	var hello datacenterHello
+	if err := wire.ReadJSON(reader, wire.Introduce, &hello); err != nil {
+		fmt.Println("Bad datacenter introduction", err)
+		return
+	}
+	if hello.Consistency != consistency {
+		fmt.Println("Datacenter", hello.From, "runs in", hello.Consistency, "mode, this one in", consistency, "mode")
+	}
+	last := lastDelivered(hello.From, hello.Incarnation)
+	fmt.Println("Datacenter", hello.From, "linked, resuming after", last)
+	writer := bufio.NewWriter(conn)
+	if writeAck(writer, last) != nil {
+		return
+	}
+
 	receiveChannel := make(chan MessageFull, 100)
 	defer close(receiveChannel)
 	registrationChannel <- Registration{
-		toBroker:   receiveChannel,
-		fromBroker: nil,
+		toBroker:     receiveChannel,
+		fromBroker:   nil,
+		isDatacenter: true,
+		datacenter:   hello.From,
 	}
 
-	defer conn.Close()
+	// Parts of a transaction are held until the whole transaction has arrived
+	assemble := txAssembler()
+
 	for {
-		// Messages between datacenters are encoded in JSON
-		jsonStr, err := reader.ReadString('\n')
-		if err != nil {
+		// Packets between datacenters are encoded in JSON. The other side sends
+		// heartbeats, a link that stays quiet for longer is dead
+		conn.SetReadDeadline(time.Now().Add(downAfter))
+		var packet datacenterPacket
+		if err := wire.ReadJSON(reader, wire.Packet, &packet); err != nil {
 			fmt.Println("Trouble receiving message", err)
 			return
 		}
-		var message MessageFull
-		if json.Unmarshal([]byte(jsonStr), &message) != nil {
-			fmt.Println("Could not unpack JSON message", err)
-			return
+		if packet.Heartbeat {
+			if writeAck(writer, last) != nil {
+				return
+			}
+			continue
+		}
+		if packet.Applied != nil || packet.Members != nil {
+			for datacenter, clock := range packet.Applied {
+				reportApplied(datacenter, clock)
+			}
+			if packet.Members != nil {
+				members.mergeView(packet.Members)
+			}
+			continue
+		}
+		if packet.Seq <= last {
+			fmt.Println("Dropping duplicate packet", packet.Seq, "from", hello.From)
+			continue
 		}
+		message := packet.Message
 		fmt.Println("Received message from other datacenter: " + message.ToString())
 
-		receiveChannel <- message
+		group := assemble(message)
+		if group == nil {
+			continue
+		}
+		for _, message := range group {
+			receiveChannel <- message
+		}
+		// The parts of a group have consecutive numbers, so everything up to this
+		// packet has been handed on
+		last = packet.Seq
+		setDelivered(hello.From, hello.Incarnation, last)
+		if writeAck(writer, last) != nil {
+			return
+		}
 	}
 }
@@ -0,0 +1,34 @@
+package main
+
+import "testing"
+
+func TestDatacenterProgress(t *testing.T) {
+	lastDelivered, setDelivered := datacenterProgress()
+	for _, step := range []struct {
+		name        string
+		datacenter  string
+		incarnation string
+		set         int
+		want        int
+	}{
+		{name: "unknown datacenter", datacenter: "a", incarnation: "1", set: 4, want: -1},
+		{name: "resumes", datacenter: "a", incarnation: "1", set: 7, want: 4},
+		{name: "other datacenter", datacenter: "b", incarnation: "1", set: -1, want: -1},
+		{name: "restarted", datacenter: "a", incarnation: "2", set: 2, want: -1},
+		{name: "restarted resumes", datacenter: "a", incarnation: "2", set: -1, want: 2},
+	} {
+		if got := lastDelivered(step.datacenter, step.incarnation); got != step.want {
+			t.Fatalf("%s: last delivered %d, want %d", step.name, got, step.want)
+		}
+		if step.set >= 0 {
+			setDelivered(step.datacenter, step.incarnation, step.set)
+		}
+	}
+
+	// The link to the old incarnation may still be winding down, what it delivers
+	// doesn't count
+	setDelivered("a", "1", 9)
+	if got := lastDelivered("a", "2"); got != 2 {
+		t.Fatalf("late delivery from an old incarnation: last delivered %d, want 2", got)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+// Messages only carry their nearest dependencies: those that aren't implied by
+// another of their dependencies. If a client has seen B{3}, which itself depended on
+// A{7}, a message it sends only needs to depend on B{3}: nobody can see B{3} before
+// A{7}, so staging still delays it correctly. This keeps dependencies from growing
+// with every client ever seen.
+//
+// Pruning (and anything that needs to know everything a message depends on, like
+// telling whether two writes are concurrent) uses the full causal past of messages.
+// The store keeps it for every message it has committed until the message has been
+// stable for a while (see stability.go). Once its past is pruned a message still
+// counts as a dependency, only what it implied is no longer known
+type causalPasts map[MessageID]VectorClock
+
+// Records the full causal past of a message that is being committed and returns it.
+// Its dependencies have been committed before it, so their pasts are known
+func (pasts causalPasts) record(message MessageFull) VectorClock {
+	past := pasts.expand(message.Dependencies)
+	pasts[message.ID] = past
+	return past
+}
+
+// Returns the dependencies together with everything they depend on
+func (pasts causalPasts) expand(dependencies VectorClock) VectorClock {
+	expanded := dependencies.Copy()
+	for host, clock := range dependencies {
+		expanded.Merge(pasts[MessageID{Host: host, Clock: clock}])
+	}
+	return expanded
+}
+
+// Forgets the pasts of the messages included in frontier, returns how many
+func (pasts causalPasts) prune(frontier VectorClock) int {
+	pruned := 0
+	for id := range pasts {
+		if frontier.Includes(id) {
+			delete(pasts, id)
+			pruned++
+		}
+	}
+	return pruned
+}
+
+// Returns the dependencies without those implied by another one of them
+func (pasts causalPasts) nearest(dependencies VectorClock) VectorClock {
+	nearest := VectorClock{}
+	for host, clock := range dependencies {
+		dependency := MessageID{Host: host, Clock: clock}
+		implied := false
+		for otherHost, otherClock := range dependencies {
+			if otherHost != host && pasts[MessageID{Host: otherHost, Clock: otherClock}].Includes(dependency) {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			nearest[host] = clock
+		}
+	}
+	return nearest
+}
+
+// Reduces a client's state to the nearest dependencies for its next message. The
+// store answers right away: a dependency it hasn't committed yet has no known past,
+// so it implies nothing and is kept
+func nearestDependencies(storeReads chan<- kvRead, state VectorClock) VectorClock {
+	reply := make(chan kvReply)
+	storeReads <- kvRead{context: state, dependencies: nearestQuery, reply: reply}
+	return (<-reply).visible
+}
+
+// Passes the messages from in on to out with their dependencies reduced to the
+// nearest ones, in the order they came. It runs apart from the rest of a client's
+// pipeline so that a busy store only holds up the client's writes on their way to the
+// broker, not the client. Once in is closed, out is closed
+func attachNearest(storeReads chan<- kvRead, in <-chan MessageFull, out chan<- MessageFull) {
+	defer close(out)
+	for message := range in {
+		message.Dependencies = nearestDependencies(storeReads, message.Dependencies)
+		out <- message
+	}
+}
+
+// Expands a message's (nearest) dependencies to its full causal past. If wait is set
+// the store answers once it has committed all of them, otherwise it answers right away
+// and the past of a dependency it hasn't committed yet is left out (the dependency
+// itself is kept)
+func expandDependencies(storeReads chan<- kvRead, dependencies VectorClock, wait bool) VectorClock {
+	query := expandQuery
+	if !wait {
+		query = knownPastQuery
+	}
+	reply := make(chan kvReply)
+	storeReads <- kvRead{context: dependencies, dependencies: query, reply: reply}
+	return (<-reply).visible
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Every datacenter link sends a heartbeat every heartbeatEvery and the other side
+// answers it (with an acknowledgement), so a link hears from its peer regularly even
+// when there is nothing to send. A peer that has been silent for suspectAfter is
+// suspected, one that has been silent for downAfter is down: the link drops the
+// connection (it may be half open, which TCP takes very long to notice) and redials
+// with backoff until the peer answers again
+const (
+	heartbeatEvery = 500 * time.Millisecond
+	suspectAfter   = 3 * heartbeatEvery
+	downAfter      = 10 * heartbeatEvery
+)
+
+type peerStatus string
+
+const (
+	peerUp        peerStatus = "up"
+	peerSuspected peerStatus = "suspected"
+	peerDown      peerStatus = "down"
+	// The peer left the system, it is no longer tracked
+	peerLeft peerStatus = "left"
+)
+
+// The status of a peer that has been silent for silence
+func statusAfter(silence time.Duration) peerStatus {
+	if silence >= downAfter {
+		return peerDown
+	}
+	if silence >= suspectAfter {
+		return peerSuspected
+	}
+	return peerUp
+}
+
+// What the failure detector says about a peer
+type peerHealth struct {
+	Peer   string
+	Status peerStatus
+	// When the status last changed
+	Since time.Time
+	// When the peer was last heard from, zero if never
+	LastHeard time.Time
+}
+
+func (health peerHealth) ToString() string {
+	heard := "never heard from"
+	if !health.LastHeard.IsZero() {
+		heard = fmt.Sprint("heard from ", time.Since(health.LastHeard).Round(time.Millisecond), " ago")
+	}
+	return fmt.Sprint(health.Peer, " ", health.Status, " for ", time.Since(health.Since).Round(time.Second), ", ", heard)
+}
+
+// Tracks the health of the peers this datacenter links to. Returns a function that
+// links report to (the peer's status and when it was last heard from) and one that
+// lists the health of every peer. Changes of status are logged
+func healthTracker() (func(string, peerStatus, time.Time), func() []peerHealth) {
+	type report struct {
+		peer      string
+		status    peerStatus
+		lastHeard time.Time
+	}
+	reports := make(chan report, 100)
+	queries := make(chan chan []peerHealth)
+
+	go func() {
+		peers := map[string]peerHealth{}
+		for {
+			select {
+			case r := <-reports:
+				health, found := peers[r.peer]
+				if r.status == peerLeft {
+					delete(peers, r.peer)
+					continue
+				}
+				if !found || health.Status != r.status {
+					fmt.Println("Health-peer", r.peer, "is", r.status)
+					health = peerHealth{Peer: r.peer, Status: r.status, Since: time.Now()}
+				}
+				if r.lastHeard.After(health.LastHeard) {
+					health.LastHeard = r.lastHeard
+				}
+				peers[r.peer] = health
+			case reply := <-queries:
+				list := []peerHealth{}
+				for _, health := range peers {
+					list = append(list, health)
+				}
+				sort.Slice(list, func(i, j int) bool { return list[i].Peer < list[j].Peer })
+				reply <- list
+			}
+		}
+	}()
+
+	reportHealth := func(peer string, status peerStatus, lastHeard time.Time) {
+		reports <- report{peer: peer, status: status, lastHeard: lastHeard}
+	}
+	peerHealthList := func() []peerHealth {
+		reply := make(chan []peerHealth)
+		queries <- reply
+		return <-reply
+	}
+	return reportHealth, peerHealthList
+}
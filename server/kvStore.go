@@ -0,0 +1,335 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A value written to a key along with the metadata of the write that produced it.
+// The write's dependencies double as the version's metadata: they say which other
+// versions (of any key) were visible to the writer
+type Version struct {
+	Key          string
+	ID           MessageID
+	Value        []byte
+	Dependencies VectorClock
+	Lamport      int
+}
+
+// A request to read keys once everything in context is visible at this datacenter.
+// The context is what the reading client has already seen (including its own
+// writes), waiting for it gives read-your-writes and causal reads
+type kvRead struct {
+	keys    []string
+	context VectorClock
+	// If set, each key is read as of this cut (the newest version the cut includes)
+	// instead of the latest committed version
+	cut VectorClock
+	// If set, nothing is read: the operation is prepared against the CRDT at keys[0]
+	prepare *crdtOp
+	// If set, nothing is read: the context is reduced to its nearest dependencies or
+	// expanded to its full causal past (see dependencies.go)
+	dependencies dependencyQuery
+	reply        chan kvReply
+}
+
+type dependencyQuery int
+
+const (
+	noQuery dependencyQuery = iota
+	// Reduced as far as the store knows, without waiting for the context
+	nearestQuery
+	expandQuery
+	// Expanded as far as the store knows, without waiting for the context
+	knownPastQuery
+)
+
+type kvReply struct {
+	versions []Version
+	// Everything that was visible at the store when it answered, or the answer to a
+	// dependency query
+	visible VectorClock
+	err     error
+}
+
+// Reads keys from the store, in the same order. A key that has no value is returned
+// as a Version without an ID, a key with concurrent values may return several
+// versions (depending on the store's conflict resolver)
+func storeRead(storeReads chan<- kvRead, keys []string, context VectorClock, cut VectorClock) []Version {
+	reply := make(chan kvReply)
+	storeReads <- kvRead{keys: keys, context: context, cut: cut, reply: reply}
+	return (<-reply).versions
+}
+
+// Reads a causally consistent snapshot of keys in two rounds (as in COPS-GT). The
+// first round gets the latest version of every key. Those versions may come from
+// different points in time: one of them may depend on a newer version of another key
+// than the one that was read. The union of what the versions depend on is a causal cut
+// that covers all of them, so the second round reads every key as of that cut. The
+// store keeps old versions, so newer writes committed in between don't get in the way
+func readTransaction(storeReads chan<- kvRead, keys []string, context VectorClock) []Version {
+	firstRound := storeRead(storeReads, keys, context, nil)
+
+	cut := context.Copy()
+	for _, version := range firstRound {
+		if version.ID.Host != "" {
+			cut.Witness(version.ID)
+			cut.Merge(version.Dependencies)
+		}
+	}
+	return storeRead(storeReads, keys, context, cut)
+}
+
+// The datacenter's replicated multi-version key-value store. It hears every message
+// from the broker (local clients and other datacenters alike) and runs them through
+// the same staging as a client would, so a write is only committed after everything
+// it depends on has been committed. Reads come in on the reads channel, concurrent
+// writes to a key are settled by the resolver when the key is read. Besides plain
+// values, the store holds the CRDT objects that CrdtMessages operate on. They are
+// always read in their current state, they have no history. A recovering store starts
+// out with the restored state (nil if there is none), its state is requested on
+// snapshotRequests. Whatever it has committed is reported to applied, the causal
+// pasts of messages that have been stable for retention are dropped
+func kvStore(registrationChannel chan<- Registration, reads <-chan kvRead, resolver ConflictResolver, staging stagingConfig, restored *storeSnapshot, snapshotRequests <-chan chan storeSnapshot, applied func(VectorClock), stability <-chan stabilityUpdate, retention time.Duration) {
+	fromBroker := make(chan MessageFull, 100)
+	// The broker's history is empty unless this datacenter is recovering from its
+	// log, then the store rebuilds from it. What the restored state already holds
+	// is dropped in staging
+	registrationChannel <- Registration{
+		toBroker:      nil,
+		fromBroker:    fromBroker,
+		replayHistory: true,
+	}
+
+	// Every version of every key, in the order they were committed. The dependencies
+	// of a version are the full causal past of its write, so whether one version
+	// overwrote another can be read right off them
+	history := map[string][]Version{}
+	pasts := causalPasts{}
+	// The CRDT objects, their types, the last operation applied to each and the causal
+	// past of all the operations applied to each (themselves included)
+	objects := map[string]CRDT{}
+	objectTypes := map[string]string{}
+	lastOps := map[string]MessageID{}
+	objectPasts := map[string]VectorClock{}
+	// Everything committed so far. Chat messages are "committed" too (they carry no
+	// data) because the contexts of reads include them
+	visible := VectorClock{}
+	if restored != nil {
+		if err := restored.restoreInto(history, pasts, objects, objectTypes, lastOps, objectPasts); err != nil {
+			fmt.Println("Couldn't restore the store", err)
+		}
+		visible = restored.Visible.Copy()
+	}
+	// Reads waiting for their context to become visible
+	pendingReads := []kvRead{}
+	// Stable frontiers waiting out the retention before the pasts they include are
+	// pruned
+	frontiers := &retainedFrontiers{retention: retention}
+	pruneTicker := time.NewTicker(time.Second)
+	defer pruneTicker.Stop()
+	prune := func() {
+		if frontier := frontiers.due(); frontier != nil {
+			if pruned := pasts.prune(frontier); pruned > 0 {
+				fmt.Println("Store pruned the causal pasts of", pruned, "stable messages")
+			}
+		}
+	}
+
+	// The store's state is what has been committed here, it is managed and staged
+	// just like a client's state. Nothing may expire, every write has to be committed,
+	// and every client's writes are committed in the order they were made
+	csSubscribeFn, csUpdateFn := clientSateManager(visible, nil)
+	committable := make(chan MessageFull, 100)
+	staging.expireAfter = 0
+	staging.writerOrder = true
+	go clientStaging("store", staging, fromBroker, csSubscribeFn(), committable, nil)
+
+	// The writes of a transaction are held back until all of them are committable,
+	// then they are committed together so no read sees part of a transaction
+	assemble := txAssembler()
+
+	tryAnswering := func(read kvRead) bool {
+		switch read.dependencies {
+		case nearestQuery:
+			read.reply <- kvReply{visible: pasts.nearest(read.context)}
+			return true
+		case knownPastQuery:
+			read.reply <- kvReply{visible: pasts.expand(read.context)}
+			return true
+		}
+		if !visible.Dominates(read.context) {
+			return false
+		}
+		switch read.dependencies {
+		case expandQuery:
+			read.reply <- kvReply{visible: pasts.expand(read.context)}
+			return true
+		}
+		if read.prepare != nil {
+			read.reply <- kvReply{visible: visible.Copy(), err: prepareOn(objects, objectTypes, read.keys[0], read.prepare)}
+			return true
+		}
+		versions := []Version{}
+		for _, key := range read.keys {
+			if object, found := objects[key]; found {
+				versions = append(versions, Version{Key: key, ID: lastOps[key], Value: []byte(object.Value()), Dependencies: objectPasts[key].Copy()})
+				continue
+			}
+			versions = append(versions, versionsAt(key, history[key], read.cut, resolver)...)
+		}
+		read.reply <- kvReply{versions: versions, visible: visible.Copy()}
+		return true
+	}
+
+	for {
+		select {
+		case message := <-committable:
+			for _, message := range assemble(message) {
+				past := pasts.record(message)
+				if message.Kind == PutMessage {
+					fmt.Println("Store committing", message.MessageBasic.ToString())
+					history[message.Key] = append(history[message.Key], Version{
+						Key:          message.Key,
+						ID:           message.ID,
+						Value:        message.Body,
+						Dependencies: past,
+						Lamport:      message.Lamport,
+					})
+				}
+				if message.Kind == CrdtMessage {
+					applyOn(objects, objectTypes, message)
+					lastOps[message.Key] = message.ID
+					if objectPasts[message.Key] == nil {
+						objectPasts[message.Key] = VectorClock{}
+					}
+					objectPasts[message.Key].Merge(past)
+					objectPasts[message.Key].Witness(message.ID)
+				}
+				visible.Witness(message.ID)
+				csUpdateFn(message.ID)
+			}
+			applied(visible.Copy())
+
+			stillPending := []kvRead{}
+			for _, read := range pendingReads {
+				if !tryAnswering(read) {
+					stillPending = append(stillPending, read)
+				}
+			}
+			pendingReads = stillPending
+		case read := <-reads:
+			if !tryAnswering(read) {
+				fmt.Println("Read of", read.keys, "waiting for", read.context.ToString())
+				pendingReads = append(pendingReads, read)
+			}
+		case reply := <-snapshotRequests:
+			snap, err := takeStoreSnapshot(visible, history, pasts, objects, objectTypes, lastOps, objectPasts)
+			if err != nil {
+				fmt.Println("Couldn't snapshot the store", err)
+			}
+			reply <- snap
+		case update := <-stability:
+			frontiers.observe(update.Stable)
+			prune()
+		case <-pruneTicker.C:
+			prune()
+		}
+	}
+}
+
+// Prepares op against the object at key (an empty one if there is none yet)
+func prepareOn(objects map[string]CRDT, objectTypes map[string]string, key string, op *crdtOp) error {
+	object, found := objects[key]
+	if !found {
+		var err error
+		if object, err = newCRDT(op.Type); err != nil {
+			return err
+		}
+	} else if objectTypes[key] != op.Type {
+		return fmt.Errorf("%s is a %s, not a %s", key, objectTypes[key], op.Type)
+	}
+	return object.Prepare(op)
+}
+
+// Applies the operation carried by message to its object, creating the object on
+// its first operation
+func applyOn(objects map[string]CRDT, objectTypes map[string]string, message MessageFull) {
+	op, err := decodeCrdtOp(message.Body)
+	if err != nil {
+		fmt.Println("Dropping malformed CRDT operation", message.MessageBasic.ToString(), err)
+		return
+	}
+	object, found := objects[message.Key]
+	if !found {
+		if object, err = newCRDT(op.Type); err != nil {
+			fmt.Println("Dropping CRDT operation", message.MessageBasic.ToString(), err)
+			return
+		}
+		objects[message.Key] = object
+		objectTypes[message.Key] = op.Type
+	} else if objectTypes[message.Key] != op.Type {
+		// Objects can't change type. Only clients that create the same object with
+		// different types concurrently get here, and that is their error
+		fmt.Println("Dropping CRDT operation for the wrong type", message.MessageBasic.ToString())
+		return
+	}
+	fmt.Println("Store applying", message.MessageBasic.ToString())
+	object.Apply(message, op)
+}
+
+// Copies the store's state into a snapshot
+func takeStoreSnapshot(visible VectorClock, history map[string][]Version, pasts causalPasts, objects map[string]CRDT, objectTypes map[string]string, lastOps map[string]MessageID, objectPasts map[string]VectorClock) (storeSnapshot, error) {
+	snap := storeSnapshot{
+		Visible:     visible.Copy(),
+		Versions:    map[string][]Version{},
+		Objects:     map[string]crdtSnapshot{},
+		LastOps:     map[string]MessageID{},
+		ObjectPasts: map[string]VectorClock{},
+	}
+	for key, versions := range history {
+		snap.Versions[key] = append([]Version{}, versions...)
+	}
+	for id, past := range pasts {
+		snap.Pasts = append(snap.Pasts, messagePast{ID: id, Past: past})
+	}
+	for key, object := range objects {
+		encoded, err := newCrdtSnapshot(objectTypes[key], object)
+		if err != nil {
+			return snap, err
+		}
+		snap.Objects[key] = encoded
+	}
+	for key, id := range lastOps {
+		snap.LastOps[key] = id
+	}
+	for key, past := range objectPasts {
+		snap.ObjectPasts[key] = past.Copy()
+	}
+	return snap, nil
+}
+
+// Fills the store's (empty) state from the snapshot
+func (snap *storeSnapshot) restoreInto(history map[string][]Version, pasts causalPasts, objects map[string]CRDT, objectTypes map[string]string, lastOps map[string]MessageID, objectPasts map[string]VectorClock) error {
+	for key, versions := range snap.Versions {
+		history[key] = versions
+	}
+	for _, entry := range snap.Pasts {
+		pasts[entry.ID] = entry.Past
+	}
+	for key, encoded := range snap.Objects {
+		object, err := encoded.restore()
+		if err != nil {
+			return err
+		}
+		objects[key] = object
+		objectTypes[key] = encoded.Type
+	}
+	for key, id := range snap.LastOps {
+		lastOps[key] = id
+	}
+	for key, past := range snap.ObjectPasts {
+		objectPasts[key] = past
+	}
+	return nil
+}
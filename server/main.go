@@ -2,9 +2,17 @@ package main
 
 import (
 	"bufio"
+	"flag"
 	"fmt"
 	"net"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+
+	"wire"
 )
 
 func main() {
@@ -12,11 +20,47 @@ func main() {
 	fmt.Println("##### SERVER #####")
 	fmt.Println("##################")
 
+	// All datacenters should settle conflicting writes the same way
+	resolverName := flag.String("resolver", "lww", "how concurrent writes to a key are settled: lww, multi, "+mergeCallbackNames())
+	// Limits of the staging areas (one per client and one for the store)
+	staging := stagingConfig{}
+	flag.IntVar(&staging.memoryLimit, "staging-limit", 1000, "messages each staging area keeps in memory before spilling to disk")
+	flag.StringVar(&staging.spillDir, "spill-dir", os.TempDir(), "directory for staging spill files")
+	flag.DurationVar(&staging.expireAfter, "staging-expiry", 0, "drop messages waiting in a client's staging area for longer than this (0 never drops)")
+	flag.DurationVar(&staging.stuckAfter, "stuck-after", time.Minute, "report messages waiting in staging for longer than this")
+	walDir := flag.String("wal-dir", ".", "directory for the write-ahead log and snapshots the datacenter recovers from after a crash (empty disables them)")
+	snapshotEvery := flag.Duration("snapshot-every", time.Minute, "how often to snapshot the datacenter and compact its log (0 never does)")
+	retention := flag.Duration("history-retention", 10*time.Minute, "how long stable messages stay in the history that is replayed to new clients (and their causal pasts in the store)")
+	antiEntropyEvery := flag.Duration("anti-entropy-every", 30*time.Second, "how often to sync with every other datacenter to repair missed messages (0 never does)")
+	relay := flag.Bool("relay", false, "pass messages from other datacenters on to the datacenters this one is linked to")
+	peers := flag.String("peers", "", "comma separated ports of the datacenters to link to (default: all the others)")
+	join := flag.String("join", "", "port of a datacenter to join the system through, instead of starting out with the ports given")
+	consistencyName := flag.String("consistency", string(causalConsistency), "consistency clients get, to compare what causal consistency buys: eventual, fifo, causal")
+	inspect := flag.String("inspect", "", "print what the snapshot file holds and exit")
+	flag.Parse()
+	resolver, err := newConflictResolver(*resolverName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+	consistency, err := parseConsistencyMode(*consistencyName)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(-1)
+	}
+
+	if *inspect != "" {
+		if err := inspectSnapshot(*inspect, resolver); err != nil {
+			fmt.Println(err)
+			os.Exit(-1)
+		}
+		return
+	}
+
 	// Listen
 	host := "localhost"
-	datacenterPorts := os.Args[1:]
+	datacenterPorts := flag.Args()
 	var listener net.Listener
-	var err error
 	found := false
 	var localPort string = ""
 	// Try ports in the pool (args) until it finds one that is available
@@ -36,20 +80,119 @@ func main() {
 	}
 
 	fmt.Println("Listening on port:", localPort)
+	fmt.Println("Consistency mode:", consistency)
 	defer listener.Close()
 
+	// Datacenters are known by their address. Unless it joins through another one, a
+	// datacenter starts out with the ports given as the members
+	local := datacenterHello{From: host + ":" + localPort, Incarnation: fmt.Sprint(time.Now().UnixNano()), Consistency: consistency}
+	initialMembers := memberView{}
+	var transferred *snapshot
+	if *join != "" {
+		reply, err := joinSystem(host+":"+*join, local.From)
+		if err != nil {
+			fmt.Println("Could not join through", *join+":", err)
+			os.Exit(-1)
+		}
+		fmt.Println("Joined through", *join, "with", len(reply.State.Messages), "messages in the history")
+		initialMembers = reply.Members
+		transferred = &reply.State
+	} else {
+		for _, port := range datacenterPorts {
+			initialMembers[host+":"+port] = memberEntry{}
+		}
+	}
+
+	// The log and snapshot are named after the port, a datacenter restarted on the
+	// same port picks up where it left off
+	var wal *writeAheadLog
+	var restored *snapshot
+	snapshotPath := filepath.Join(*walDir, "datacenter-"+localPort+".snapshot")
+	if *walDir != "" {
+		restored, err = loadSnapshot(snapshotPath)
+		if err != nil {
+			fmt.Println("Could not load the snapshot:", err)
+			os.Exit(-1)
+		}
+	}
+	// A datacenter that joins with nothing of its own starts from what it was handed
+	if restored == nil {
+		restored = transferred
+	}
+	if *walDir != "" {
+		wal, err = openWriteAheadLog(filepath.Join(*walDir, "datacenter-"+localPort+".wal"), restored)
+		if err != nil {
+			fmt.Println("Could not open the write-ahead log:", err)
+			os.Exit(-1)
+		}
+	}
+	var restoredStore *storeSnapshot
+	if restored != nil {
+		restoredStore = &restored.Store
+	}
+
 	// Channel for client/datacenter handlers to register with the message
 	// broker so that they can send/receive messages to other components
 	registrationChannel := make(chan Registration, 10)
 
-	go messageBroker(registrationChannel)
+	// What each member has applied is tracked to tell which messages are stable, and
+	// the links keep track of whether the datacenters at the other end are alive
+	members := newMembership(local.From, initialMembers)
+	subscribeStability, reportApplied := stabilityTracker(local.From, members.subscribe())
+	reportHealth, peerHealthList := healthTracker()
+
+	// The broker's history starts out with what the log recovered (without a log, with
+	// what was handed over on joining)
+	recovered, compacted := wal.recoveredHistory()
+	if wal == nil && restored != nil {
+		recovered, compacted = restored.Messages, restored.Compacted
+	}
+	brokerSnapshots := make(chan snapshotRequest)
+	digestRequests := make(chan antiEntropyRequest)
+	// What anti-entropy repairs goes to the broker as if it came over a link
+	injectMissing := antiEntropyInjector(registrationChannel)
+	go messageBroker(registrationChannel, restoredMessageLog(recovered, compacted), wal, brokerSnapshots, digestRequests, subscribeStability(), *retention, *relay)
+
+	// The replicated key-value store, clients read from it through storeReads
+	storeReads := make(chan kvRead, 100)
+	storeSnapshots := make(chan chan storeSnapshot)
+	applied := func(clock VectorClock) { reportApplied(local.From, clock) }
+	go kvStore(registrationChannel, storeReads, resolver, staging, restoredStore, storeSnapshots, applied, subscribeStability(), *retention)
+
+	if wal != nil && *snapshotEvery > 0 {
+		go snapshotter(snapshotPath, *snapshotEvery, wal, storeSnapshots, brokerSnapshots)
+	}
 
-	// Connect to other datacenters
-	for _, remotePort := range datacenterPorts {
-		if remotePort != localPort {
-			go datacenterOutgoing(host, remotePort, registrationChannel)
+	// Connect to other datacenters as they become members, disconnect as they leave.
+	// Links number their packets per incarnation of this datacenter, a restart starts
+	// over. Without a full mesh (e.g. a ring, star or tree) datacenters that aren't
+	// linked hear from each other through relays
+	linked := []string{}
+	if *peers != "" {
+		for _, port := range strings.Split(*peers, ",") {
+			linked = append(linked, host+":"+port)
 		}
 	}
+	go linkManager(local.From, linked, members.subscribe(), func(remote string, stop <-chan struct{}) {
+		remoteHost, remotePort, _ := net.SplitHostPort(remote)
+		go datacenterOutgoing(remoteHost, remotePort, registrationChannel, local, subscribeStability(), members.subscribe(), stop, reportHealth)
+		if *antiEntropyEvery > 0 {
+			go antiEntropy(remote, local.From, *antiEntropyEvery, injectMissing, digestRequests, stop)
+		}
+	})
+
+	// Interrupting the datacenter makes it leave the system gracefully
+	interrupts := make(chan os.Signal, 1)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-interrupts
+		fmt.Println("Leaving the system...")
+		leaveSystem(local.From, linked, members, injectMissing, digestRequests)
+		os.Exit(0)
+	}()
+
+	// What has been delivered from every other datacenter, across reconnects
+	lastDelivered, setDelivered := datacenterProgress()
 
 	for {
 		// Listen for connections from clients or datacenters (same port)
@@ -59,21 +202,25 @@ func main() {
 			fmt.Println("Error connecting:", err.Error())
 		} else {
 			fmt.Println("Connection Received from ", connection.RemoteAddr().String()[9:])
+			// Every connection starts with a handshake that says what the other side is
+			// (client/datacenter/antientropy/join) and picks the protocol version. I
+			// send the connection to the appropriate handler
 			reader := bufio.NewReader(connection)
-			endpointType, err := reader.ReadString('\n')
+			endpointType, version, err := wire.AcceptHandshake(reader, bufio.NewWriter(connection))
 			if err != nil {
-				fmt.Println("Error reading data", err.Error())
+				fmt.Println("Refusing connection from", connection.RemoteAddr(), err)
 				connection.Close()
+				continue
 			}
-
-			// The first message sent is the endpoint type (client/datacenter)
-			// I send the connection to the appropriate handler
-			endpointType = endpointType[:len(endpointType)-1]
-			fmt.Println(" of type " + endpointType)
+			fmt.Println(" of type", endpointType, "speaking protocol version", version)
 			if endpointType == "client" {
-				go registerClient(connection, reader, registrationChannel)
+				go registerClient(connection, reader, registrationChannel, storeReads, staging, wal, subscribeStability, peerHealthList, consistency)
 			} else if endpointType == "datacenter" {
-				go datacenterIncoming(connection, reader, registrationChannel)
+				go datacenterIncoming(connection, reader, registrationChannel, lastDelivered, setDelivered, reportApplied, members, consistency)
+			} else if endpointType == "join" {
+				go joinIncoming(connection, reader, members, storeSnapshots, brokerSnapshots)
+			} else if endpointType == "antientropy" {
+				go antiEntropyIncoming(connection, reader, injectMissing, digestRequests)
 			} else {
 				fmt.Println("Invalid endpoint type", endpointType, err)
 				connection.Close()
@@ -0,0 +1,272 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"sort"
+	"time"
+
+	"wire"
+)
+
+// The datacenters that make up the system. Every datacenter keeps a view of the
+// members and gossips it on its links (along with what has been applied), so changes
+// spread to everyone. A datacenter joins by contacting any member, which hands it a
+// snapshot of its state to start from and the view with it added, and only then adds
+// it to its own view. A datacenter leaves by marking itself as left.
+//
+// Every entry has a version so that views can be merged in any order: the higher
+// version wins, and at the same version having left wins. Rejoining takes a new version
+type memberEntry struct {
+	Version int
+	Left    bool `json:",omitempty"`
+	// The datacenter it joined through, empty for the initial members
+	Via string `json:",omitempty"`
+}
+
+// Datacenters by address
+type memberView map[string]memberEntry
+
+func (view memberView) copy() memberView {
+	copied := memberView{}
+	for address, entry := range view {
+		copied[address] = entry
+	}
+	return copied
+}
+
+// Merges other into the view, returns whether anything changed
+func (view memberView) merge(other memberView) bool {
+	changed := false
+	for address, theirs := range other {
+		ours, found := view[address]
+		if !found || theirs.Version > ours.Version || (theirs.Version == ours.Version && theirs.Left && !ours.Left) {
+			view[address] = theirs
+			changed = true
+		}
+	}
+	return changed
+}
+
+// The addresses of the datacenters that haven't left, in order
+func (view memberView) members() []string {
+	members := []string{}
+	for address, entry := range view {
+		if !entry.Left {
+			members = append(members, address)
+		}
+	}
+	sort.Strings(members)
+	return members
+}
+
+// Owns this datacenter's view of the members. Views heard from others are merged
+// into it and subscribers get the latest view (like stability updates, an unread
+// view is replaced by the next)
+type membership struct {
+	merges        chan memberView
+	joins         chan joinRequest
+	leaves        chan struct{}
+	addSubscriber chan chan memberView
+}
+
+type joinRequest struct {
+	address string
+	reply   chan memberView
+}
+
+func newMembership(local string, initial memberView) *membership {
+	m := &membership{
+		merges:        make(chan memberView, 100),
+		joins:         make(chan joinRequest),
+		leaves:        make(chan struct{}),
+		addSubscriber: make(chan chan memberView, 5),
+	}
+	go func() {
+		view := initial.copy()
+		leaving := false
+		subscribers := []chan memberView{}
+		publish := func(subscriber chan memberView) {
+			select {
+			case <-subscriber:
+			default:
+			}
+			subscriber <- view.copy()
+		}
+		changed := func() {
+			fmt.Println("Membership-members are now", view.members())
+			for _, subscriber := range subscribers {
+				publish(subscriber)
+			}
+		}
+		for {
+			select {
+			case newSub := <-m.addSubscriber:
+				subscribers = append(subscribers, newSub)
+				publish(newSub)
+			case other := <-m.merges:
+				if !view.merge(other) {
+					continue
+				}
+				// Someone thinks this datacenter left (it had, and came back without
+				// joining), set them straight
+				if view[local].Left && !leaving {
+					view[local] = memberEntry{Version: view[local].Version + 1, Via: view[local].Via}
+				}
+				changed()
+			case request := <-m.joins:
+				entry := memberEntry{Via: local}
+				if previous, found := view[request.address]; found {
+					entry.Version = previous.Version + 1
+				}
+				joined := view.copy()
+				joined[request.address] = entry
+				request.reply <- joined
+			case <-m.leaves:
+				leaving = true
+				entry := view[local]
+				entry.Left = true
+				view[local] = entry
+				changed()
+			}
+		}
+	}()
+	return m
+}
+
+func (m *membership) subscribe() chan memberView {
+	subscriber := make(chan memberView, 1)
+	m.addSubscriber <- subscriber
+	return subscriber
+}
+
+// Merges a view heard from another datacenter
+func (m *membership) mergeView(view memberView) {
+	m.merges <- view
+}
+
+// Returns the view with the datacenter at address added, without changing this
+// datacenter's view. Merging the returned view adds it
+func (m *membership) withJoined(address string) memberView {
+	reply := make(chan memberView)
+	m.joins <- joinRequest{address: address, reply: reply}
+	return <-reply
+}
+
+// Marks this datacenter as left
+func (m *membership) leave() {
+	m.leaves <- struct{}{}
+}
+
+// Whether this datacenter links to other directly: in a full mesh (no peers given) it
+// links to every member, otherwise to its peers and to the datacenters it joined
+// through or that joined through it
+func linksTo(view memberView, local string, peers []string, other string) bool {
+	if other == local || view[other].Left {
+		return false
+	}
+	if len(peers) == 0 {
+		return true
+	}
+	for _, peer := range peers {
+		if peer == other {
+			return true
+		}
+	}
+	return view[other].Via == local || view[local].Via == other
+}
+
+// Starts a link (with startLink) to every datacenter this one links to and stops it
+// (by closing its stop channel) when that datacenter leaves
+func linkManager(local string, peers []string, members <-chan memberView, startLink func(address string, stop <-chan struct{})) {
+	stops := map[string]chan struct{}{}
+	for view := range members {
+		for address := range view {
+			_, linked := stops[address]
+			wanted := linksTo(view, local, peers, address)
+			if wanted && !linked {
+				stop := make(chan struct{})
+				stops[address] = stop
+				startLink(address, stop)
+			} else if !wanted && linked {
+				fmt.Println("Unlinking datacenter", address)
+				close(stops[address])
+				delete(stops, address)
+			}
+		}
+	}
+}
+
+// How long a datacenter that leaves waits for its links to tell the others
+const leaveGrace = 3 * announceAppliedEvery
+
+// Leaves the system. First the datacenters this one links to get whatever they miss
+// (messages from local clients may still be waiting out their delay on the links), then
+// this datacenter is marked as left and the links get time to tell the others
+func leaveSystem(local string, peers []string, members *membership, inject func(string, []MessageFull), digestRequests chan<- antiEntropyRequest) {
+	view := <-members.subscribe()
+	for _, address := range view.members() {
+		if !linksTo(view, local, peers, address) {
+			continue
+		}
+		_, sent, err := antiEntropySession(address, local, inject, digestRequests)
+		if err != nil {
+			fmt.Println("Couldn't hand over to", address, err)
+			continue
+		}
+		fmt.Println("Handed", sent, "messages over to", address)
+	}
+	members.leave()
+	time.Sleep(leaveGrace)
+}
+
+// What a datacenter that joins gets back: the members and the state to start from
+type joinReply struct {
+	Members memberView
+	State   snapshot
+}
+
+// Joins the system through the datacenter at contact
+func joinSystem(contact string, local string) (joinReply, error) {
+	var reply joinReply
+	conn, err := net.DialTimeout("tcp", contact, antiEntropyTimeout)
+	if err != nil {
+		return reply, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(antiEntropyTimeout))
+	reader := bufio.NewReader(conn)
+	writer := bufio.NewWriter(conn)
+	if _, err := wire.Handshake(reader, writer, "join"); err != nil {
+		return reply, err
+	}
+	if err := wire.WriteJSON(writer, wire.Introduce, datacenterHello{From: local}); err != nil {
+		return reply, err
+	}
+	return reply, wire.ReadJSON(reader, wire.JoinReply, &reply)
+}
+
+// Answers a datacenter that joins through this one
+func joinIncoming(conn net.Conn, reader *bufio.Reader, members *membership, storeSnapshots chan<- chan storeSnapshot, brokerSnapshots chan<- snapshotRequest) {
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(antiEntropyTimeout))
+	var hello datacenterHello
+	if err := wire.ReadJSON(reader, wire.Introduce, &hello); err != nil {
+		fmt.Println("Bad join request", err)
+		return
+	}
+	// The joining datacenter becomes a member once it has its state, until then none
+	// of the others link to it. Its log starts afresh, so this one's isn't
+	// checkpointed, and clients aren't handed over, they stay with this datacenter
+	reply := joinReply{
+		State:   takeSnapshot(storeSnapshots, brokerSnapshots, false),
+		Members: members.withJoined(hello.From),
+	}
+	if err := wire.WriteJSON(bufio.NewWriter(conn), wire.JoinReply, reply); err != nil {
+		fmt.Println("Couldn't send the state to", hello.From, err)
+		return
+	}
+	members.mergeView(reply.Members)
+	fmt.Println("Datacenter", hello.From, "joined")
+}
@@ -1,6 +1,9 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"sort"
+)
 
 type MessageID struct {
 	Host  string
@@ -11,39 +14,267 @@ func (id MessageID) ToString() string {
 	return id.Host + "{" + fmt.Sprint(id.Clock) + "}"
 }
 
+// What a message carries
+type MessageKind string
+
+const (
+	// A line of conversation
+	ChatMessage MessageKind = ""
+	// A write of Body to Key in the key-value store
+	PutMessage MessageKind = "put"
+	// A read of Key, answered by the local store and never replicated
+	GetMessage MessageKind = "get"
+	// A read-only transaction over the keys listed (space separated) in Body,
+	// answered by the local store and never replicated
+	GetTxMessage MessageKind = "gettx"
+	// The answer to a read, sent to the client only
+	ValueMessage MessageKind = "value"
+	// An operation (a crdtOp in Body) on the CRDT object named by Key
+	CrdtMessage MessageKind = "crdt"
+	// Tells the client that one of its commands failed, sent to the client only
+	ErrorMessage MessageKind = "error"
+	// Asks for the stable frontier (what every datacenter has applied), the answer
+	// carries it in Body. Never replicated
+	StableMessage MessageKind = "stable"
+	// Asks for the health of the datacenters this one links to, the answer carries it
+	// in Body (a line per datacenter). Never replicated
+	StatusMessage MessageKind = "status"
+)
+
+// Whether messages of this kind get a MessageID and are replicated to other datacenters
+func (kind MessageKind) isReplicated() bool {
+	return kind == ChatMessage || kind == PutMessage || kind == CrdtMessage
+}
+
+// Marks a message as one of the writes of a write-only transaction. The parts of a
+// transaction have consecutive clocks starting at ID
+type TxInfo struct {
+	ID    MessageID
+	Parts int
+}
+
 type MessageBasic struct {
 	ID   MessageID
+	Kind MessageKind `json:",omitempty"`
+	Key  string      `json:",omitempty"`
 	Body []byte
+	Tx   *TxInfo `json:",omitempty"`
+}
+
+// Whether this is the final part of a transaction (or not part of one at all)
+func (m MessageBasic) isLastPart() bool {
+	return m.Tx == nil || m.ID.Clock == m.Tx.ID.Clock+m.Tx.Parts-1
 }
 
 func (m MessageBasic) ToString() string {
+	if m.Kind != ChatMessage {
+		return "[" + m.ID.ToString() + "]" + string(m.Kind) + "(" + m.Key + ")>>" + string(m.Body)
+	}
 	return "[" + m.ID.ToString() + "]>>" + string(m.Body)
 }
 
-type ClientState []MessageID
+// A vector clock maps each host to the clock of the latest of its messages that has
+// been seen. Hosts number their messages from 0 and deliver them in order, so seeing
+// Host{Clock} implies having seen every earlier message from Host. A host that is
+// missing from the map has not been seen at all (-1)
+type VectorClock map[string]int
+
+// How two vector clocks relate to each other
+type Ordering int
+
+const (
+	Equal Ordering = iota
+	Before
+	After
+	Concurrent
+)
+
+func (o Ordering) ToString() string {
+	return [...]string{"equal", "before", "after", "concurrent"}[o]
+}
+
+// Returns the clock of the latest message seen from host, or -1 if none was
+func (vc VectorClock) Get(host string) int {
+	clock, found := vc[host]
+	if !found {
+		return -1
+	}
+	return clock
+}
+
+// Returns a copy that can be modified (or handed to another go routine) independently
+func (vc VectorClock) Copy() VectorClock {
+	out := make(VectorClock, len(vc))
+	for host, clock := range vc {
+		out[host] = clock
+	}
+	return out
+}
+
+// Advances the clock of host by one and returns the id of that new event
+func (vc VectorClock) Increment(host string) MessageID {
+	vc[host] = vc.Get(host) + 1
+	return MessageID{Host: host, Clock: vc[host]}
+}
+
+// Records that the message id (and so every earlier one from its host) has been seen
+func (vc VectorClock) Witness(id MessageID) {
+	if id.Clock > vc.Get(id.Host) {
+		vc[id.Host] = id.Clock
+	}
+}
+
+// Updates the clock to the element-wise maximum of itself and other
+func (vc VectorClock) Merge(other VectorClock) {
+	for host, clock := range other {
+		if clock > vc.Get(host) {
+			vc[host] = clock
+		}
+	}
+}
+
+// Returns the element-wise minimum of the clocks: what both have seen
+func (vc VectorClock) Meet(other VectorClock) VectorClock {
+	out := VectorClock{}
+	for host, clock := range vc {
+		if otherClock := other.Get(host); otherClock < clock {
+			clock = otherClock
+		}
+		if clock >= 0 {
+			out[host] = clock
+		}
+	}
+	return out
+}
+
+// The number of messages seen. One more than this is a valid Lamport timestamp for
+// the next message: whoever has seen a message has also seen everything its sender had
+func (vc VectorClock) Count() int {
+	count := 0
+	for _, clock := range vc {
+		count += clock + 1
+	}
+	return count
+}
+
+// Whether the message id has been seen
+func (vc VectorClock) Includes(id MessageID) bool {
+	return vc.Get(id.Host) >= id.Clock
+}
 
-func (cs ClientState) ToString() string {
+// Whether everything seen by other has also been seen by vc
+func (vc VectorClock) Dominates(other VectorClock) bool {
+	for host, clock := range other {
+		if vc.Get(host) < clock {
+			return false
+		}
+	}
+	return true
+}
+
+// Compares the clocks: Before means vc happened before other, After the
+// reverse and Concurrent that neither has seen everything the other has
+func (vc VectorClock) Compare(other VectorClock) Ordering {
+	vcDominates := vc.Dominates(other)
+	otherDominates := other.Dominates(vc)
+	switch {
+	case vcDominates && otherDominates:
+		return Equal
+	case otherDominates:
+		return Before
+	case vcDominates:
+		return After
+	default:
+		return Concurrent
+	}
+}
+
+// Hosts of the clock in a stable order
+func (vc VectorClock) hosts() []string {
+	hosts := make([]string, 0, len(vc))
+	for host := range vc {
+		hosts = append(hosts, host)
+	}
+	sort.Strings(hosts)
+	return hosts
+}
+
+func (vc VectorClock) ToString() string {
 	out := ""
-	for _, entry := range cs {
-		out += entry.ToString()
+	for _, host := range vc.hosts() {
+		out += MessageID{Host: host, Clock: vc[host]}.ToString()
 	}
 	return out
 }
 
 type MessageFull struct {
 	MessageBasic
-	Dependencies ClientState
+	Dependencies VectorClock
+	// A Lamport timestamp: if a happened before b then a's is lower. Used to order
+	// concurrent writes the same way at every datacenter
+	Lamport int `json:",omitempty"`
+	// The sender's previous message, when this one doesn't depend on it (the sender
+	// didn't ask for monotonic writes). Stores still apply a client's messages in
+	// order, so datacenters agree on what they have applied
+	Follows *MessageID `json:",omitempty"`
+}
+
+// Where a message sits in the total order used to settle concurrent writes: by
+// Lamport timestamp, then host and clock. It respects causality and is the same at
+// every datacenter
+type Stamp struct {
+	Lamport int
+	ID      MessageID
+}
+
+func (m MessageFull) stamp() Stamp {
+	return Stamp{Lamport: m.Lamport, ID: m.ID}
+}
+
+func (stamp Stamp) before(other Stamp) bool {
+	if stamp.Lamport != other.Lamport {
+		return stamp.Lamport < other.Lamport
+	}
+	if stamp.ID.Host != other.ID.Host {
+		return stamp.ID.Host < other.ID.Host
+	}
+	return stamp.ID.Clock < other.ID.Clock
 }
 
 func (m MessageFull) ToString() string {
 	depString := "\n\n-----------------------\n"
 	depString += "Message ID: " + m.MessageBasic.ID.ToString() + "\n"
 	depString += "Dependencies:\n"
-	for _, dep := range m.Dependencies {
-		depString += "\t" + dep.ToString() + "\n"
+	for _, host := range m.Dependencies.hosts() {
+		depString += "\t" + MessageID{Host: host, Clock: m.Dependencies[host]}.ToString() + "\n"
+	}
+	if m.Kind != ChatMessage {
+		depString += "Kind: " + string(m.Kind) + "\n"
+		depString += "Key: " + m.Key + "\n"
 	}
 	depString += "Body: " + string(m.MessageBasic.Body)
 
 	depString += "\n-----------------------\n\n"
 	return depString
 }
+
+// Returns a function that collects the parts of write-only transactions. It returns
+// the whole transaction (ordered by clock) once its last missing part is added and
+// nil while parts are missing. Messages that aren't part of a transaction are
+// returned right away
+func txAssembler() func(MessageFull) []MessageFull {
+	incomplete := map[MessageID][]MessageFull{}
+	return func(message MessageFull) []MessageFull {
+		if message.Tx == nil {
+			return []MessageFull{message}
+		}
+		parts := append(incomplete[message.Tx.ID], message)
+		if len(parts) < message.Tx.Parts {
+			incomplete[message.Tx.ID] = parts
+			return nil
+		}
+		delete(incomplete, message.Tx.ID)
+		sort.Slice(parts, func(i, j int) bool { return parts[i].ID.Clock < parts[j].ID.Clock })
+		return parts
+	}
+}
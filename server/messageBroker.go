@@ -1,73 +1,128 @@
 package main
 
-import "fmt"
+import (
+	"fmt"
+	"time"
+)
 
 // These are the messages that are placed on the aggregate message
 // channel, they include some extra stuff for bookkeeping purposes
 type ConsolidationMessage struct {
 	channelID    int
 	isDataCenter bool
+	datacenter   string
 	message      MessageFull
 }
 
 type DistributorReg struct {
 	channelID      int
 	isDatacenter   bool
+	datacenter     string
 	messageChannel chan MessageFull
+	replayHistory  bool
+	replayBase     chan<- VectorClock
+	unregister     bool
 }
 
 type Registration struct {
 	toBroker   chan MessageFull
 	fromBroker chan MessageFull
+	// Datacenter links only carry messages to/from local endpoints (unless the broker
+	// relays), everything else (clients, the store) hears from every source
+	isDatacenter bool
+	// The address of the datacenter at the other end of a datacenter link
+	datacenter string
+	// If set, every message seen so far is sent on fromBroker (in causal order)
+	// before any new ones
+	replayHistory bool
+	// If set, the replay starts by sending what was compacted away from the history
+	// here. Those messages aren't replayed, the endpoint has to take them as seen
+	replayBase chan<- VectorClock
+	// If set, fromBroker (registered before) gets no more messages. The broker closes
+	// it, until then it has to be drained
+	unregister bool
 }
 
 // This sends/receives messages to other components that are registered with the broker
-// through the channelRegister channel
-func messageBroker(channelRegister <-chan Registration) {
+// through the channelRegister channel. The history starts out as given (what was
+// recovered or transferred). Every message is written to the wal before it is passed
+// on. Snapshots of the history are requested on snapshotRequests, digests of it for
+// anti-entropy on digestRequests. Messages that have been stable for retention are
+// compacted away from the history. If relay is set, messages from a datacenter are
+// passed on to the other datacenters, so they don't all need to be linked directly
+func messageBroker(channelRegister <-chan Registration, history *messageLog, wal *writeAheadLog, snapshotRequests <-chan snapshotRequest, digestRequests <-chan antiEntropyRequest, stability <-chan stabilityUpdate, retention time.Duration, relay bool) {
 	// This is a helper channel to translate registration requests to add some contextual detail
 	// for tracking (assign an ID to the channel and determine if it is a datacenter)
 	endpointChan := make(chan DistributorReg, 100)
 	// All messages go through the aggregateMsgChannel from fanin to fanout
 	aggregateMsgChannel := make(chan ConsolidationMessage, 100)
 	// Fanout
-	go distributor(aggregateMsgChannel, endpointChan)
+	go distributor(aggregateMsgChannel, endpointChan, history, wal, snapshotRequests, digestRequests, stability, retention, relay)
 
 	// currentID is used to ensure we don't loopback during fanout - we only send to other endpoints
 	currentID := 0
 	for newClient := range channelRegister {
-		isServer := newClient.fromBroker == nil || newClient.toBroker == nil
+		isServer := newClient.isDatacenter
+		if newClient.unregister {
+			endpointChan <- DistributorReg{messageChannel: newClient.fromBroker, unregister: true}
+			continue
+		}
 		if newClient.toBroker != nil {
 			// Ingest route, give it its own go routine
-			go consolidator(newClient.toBroker, aggregateMsgChannel, currentID, isServer)
+			go consolidator(newClient.toBroker, aggregateMsgChannel, currentID, isServer, newClient.datacenter)
 		}
 		if newClient.fromBroker != nil {
 			// Distribution route, just register it with the endpointChan (picked up by the distributor
 			// go routine)
-			endpointChan <- DistributorReg{channelID: currentID, isDatacenter: isServer, messageChannel: newClient.fromBroker}
+			endpointChan <- DistributorReg{channelID: currentID, isDatacenter: isServer, datacenter: newClient.datacenter, messageChannel: newClient.fromBroker, replayHistory: newClient.replayHistory, replayBase: newClient.replayBase}
 		}
 		currentID++
 	}
 }
 
 // Each message source will have a respective consolidator go function running
-func consolidator(fromSource <-chan MessageFull, aggregateMsgChannel chan<- ConsolidationMessage, channelID int, isServer bool) {
+func consolidator(fromSource <-chan MessageFull, aggregateMsgChannel chan<- ConsolidationMessage, channelID int, isServer bool, datacenter string) {
 	defer fmt.Println("Consolidator ended")
 	for message := range fromSource {
 		// Place messages on the aggregateMsgChannel
-		aggregateMsgChannel <- ConsolidationMessage{channelID: channelID, isDataCenter: isServer, message: message}
+		aggregateMsgChannel <- ConsolidationMessage{channelID: channelID, isDataCenter: isServer, datacenter: datacenter, message: message}
 	}
 }
 
-func distributor(messagesForDistribution <-chan ConsolidationMessage, receiveNewEndpoint chan DistributorReg) {
+func distributor(messagesForDistribution <-chan ConsolidationMessage, receiveNewEndpoint chan DistributorReg, history *messageLog, wal *writeAheadLog, snapshotRequests <-chan snapshotRequest, digestRequests <-chan antiEntropyRequest, stability <-chan stabilityUpdate, retention time.Duration, relay bool) {
 
 	distributionList := []DistributorReg{}
+
+	// Stable frontiers waiting out the retention before the history is compacted up
+	// to them
+	frontiers := &retainedFrontiers{retention: retention}
+	compactTicker := time.NewTicker(time.Second)
+	defer compactTicker.Stop()
+	compact := func() {
+		if frontier := frontiers.due(); frontier != nil {
+			if removed := history.compact(frontier); removed > 0 {
+				fmt.Println("Compacted", removed, "stable messages away from the history")
+			}
+		}
+	}
+
 	for {
 		select {
 		case consolidationMsg := <-messagesForDistribution:
+			// Every message distributed is logged in history so it can be replayed to
+			// latecomers. A message can arrive more than once (e.g. through
+			// anti-entropy), it is only passed on the first time
+			if !history.append(consolidationMsg.message) {
+				continue
+			}
+			wal.logMessage(consolidationMsg.message)
 			// Send this to every endpoint
 			for _, endpoint := range distributionList {
 				// Datacenters only pass messages from client->DC, DC->client, client->client (no DC->DC)
-				if !consolidationMsg.isDataCenter || (consolidationMsg.isDataCenter && !endpoint.isDatacenter) {
+				// unless they relay, then DC->DC goes to every other datacenter than the one
+				// the message came from
+				relayed := relay && endpoint.datacenter != consolidationMsg.datacenter
+				if !consolidationMsg.isDataCenter || (consolidationMsg.isDataCenter && (!endpoint.isDatacenter || relayed)) {
 					// Make sure we don't loopback and send messages back to the client that sent them
 					if consolidationMsg.channelID != endpoint.channelID {
 						endpoint.messageChannel <- consolidationMsg.message
@@ -75,8 +130,54 @@ func distributor(messagesForDistribution <-chan ConsolidationMessage, receiveNew
 				}
 			}
 		case endpoint := <-receiveNewEndpoint:
+			if endpoint.unregister {
+				kept := []DistributorReg{}
+				for _, registered := range distributionList {
+					if registered.messageChannel == endpoint.messageChannel {
+						close(registered.messageChannel)
+					} else {
+						kept = append(kept, registered)
+					}
+				}
+				distributionList = kept
+				continue
+			}
 			// fmt.Println("New endpoint received for distribution", endpoint)
+			// The history is sent from this go routine so no live message can
+			// slip in ahead of it
+			if endpoint.replayBase != nil {
+				endpoint.replayBase <- history.base.Copy()
+			}
+			if endpoint.replayHistory {
+				catchUp := history.causalOrder()
+				fmt.Println("Replaying", len(catchUp), "messages to new endpoint")
+				for _, message := range catchUp {
+					endpoint.messageChannel <- message
+				}
+			}
 			distributionList = append(distributionList, endpoint)
+		case request := <-snapshotRequests:
+			snap := snapshot{Messages: history.causalOrder(), Compacted: history.base.Copy()}
+			if request.checkpoint {
+				// Only this go routine logs messages, so the whole history is in the
+				// log before the checkpoint
+				checkpoint := wal.checkpoint()
+				snap.NextSegment = checkpoint.segment
+				snap.Clients = checkpoint.clients
+			}
+			request.reply <- snap
+		case request := <-digestRequests:
+			digest := antiEntropyDigest{}
+			digest.Have, digest.Lacks = history.summary()
+			if request.theirs != nil {
+				digest.Missing = history.missingFrom(request.theirs.Have, request.theirs.Lacks)
+			}
+			request.reply <- digest
+		case update := <-stability:
+			frontiers.observe(update.Stable)
+			compact()
+		case <-compactTicker.C:
+			compact()
 		}
 	}
 }
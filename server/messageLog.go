@@ -0,0 +1,126 @@
+package main
+
+// The message log retains every message that passes through the broker so that
+// a client joining late can be caught up on the conversation before it receives
+// live messages. It is owned by the distributor go routine, so it needs no locking.
+// Stable messages are eventually compacted away; base says which ones
+type messageLog struct {
+	messages []MessageFull
+	// seen keeps the log free of duplicates
+	seen map[MessageID]bool
+	// Everything that was compacted away
+	base VectorClock
+}
+
+func newMessageLog() *messageLog {
+	return &messageLog{seen: map[MessageID]bool{}, base: VectorClock{}}
+}
+
+// A log that starts out with messages (recovered after a restart, or transferred on
+// joining) and with what had been compacted away before them
+func restoredMessageLog(messages []MessageFull, compacted VectorClock) *messageLog {
+	log := newMessageLog()
+	log.base.Merge(compacted)
+	for _, message := range messages {
+		log.append(message)
+	}
+	return log
+}
+
+// Adds a message to the log unless it is already there (or was compacted away),
+// returns whether it was added
+func (log *messageLog) append(message MessageFull) bool {
+	if log.seen[message.ID] || log.base.Includes(message.ID) {
+		return false
+	}
+	log.seen[message.ID] = true
+	log.messages = append(log.messages, message)
+	return true
+}
+
+// Removes the messages included in frontier, which must be causally closed (every
+// dependency of a message in it is in it too) so that what is left can still be
+// replayed from base
+func (log *messageLog) compact(frontier VectorClock) int {
+	kept := []MessageFull{}
+	for _, message := range log.messages {
+		if frontier.Includes(message.ID) {
+			delete(log.seen, message.ID)
+		} else {
+			kept = append(kept, message)
+		}
+	}
+	removed := len(log.messages) - len(kept)
+	log.messages = kept
+	log.base.Merge(frontier)
+	return removed
+}
+
+// Summarizes which messages the log has (or had, before compacting) as a version
+// vector, for every host the highest clock here, along with the messages below it that
+// aren't here. Messages from other datacenters arrive out of order, and a host's clocks
+// have gaps (a client's reads and failed commands use up clocks too), so both kinds of
+// holes are listed: the other side sends what it has of them and the rest is never
+// asked for again once it is compacted
+func (log *messageLog) summary() (VectorClock, []MessageID) {
+	summary := log.base.Copy()
+	for id := range log.seen {
+		if id.Clock > summary.Get(id.Host) {
+			summary[id.Host] = id.Clock
+		}
+	}
+	lacks := []MessageID{}
+	for host, clock := range summary {
+		for missing := log.base.Get(host) + 1; missing < clock; missing++ {
+			if id := (MessageID{Host: host, Clock: missing}); !log.seen[id] {
+				lacks = append(lacks, id)
+			}
+		}
+	}
+	return summary, lacks
+}
+
+// Returns the logged messages that the version vector doesn't include, or that are
+// among those it lacks, in causal order
+func (log *messageLog) missingFrom(theirs VectorClock, lacks []MessageID) []MessageFull {
+	lacking := map[MessageID]bool{}
+	for _, id := range lacks {
+		lacking[id] = true
+	}
+	missing := []MessageFull{}
+	for _, message := range log.causalOrder() {
+		if !theirs.Includes(message.ID) || lacking[message.ID] {
+			missing = append(missing, message)
+		}
+	}
+	return missing
+}
+
+// Returns the logged messages in a valid topological order, i.e. every message comes
+// after all of its dependencies and after the message it follows (its writer's
+// previous one, which staging may wait for too). Messages arrive from other datacenters with random
+// delays so arrival order is not good enough. This simulates delivery to a client
+// whose state is base; whatever can never be satisfied (its dependencies are not in
+// the log) is appended at the end and will wait in the client's staging area
+func (log *messageLog) causalOrder() []MessageFull {
+	ordered := make([]MessageFull, 0, len(log.messages))
+	state := log.base.Copy()
+	remaining := log.messages
+	for len(remaining) > 0 {
+		blocked := []MessageFull{}
+		for _, message := range remaining {
+			if state.Dominates(message.Dependencies) && (message.Follows == nil || state.Includes(*message.Follows)) {
+				ordered = append(ordered, message)
+				state.Witness(message.ID)
+			} else {
+				blocked = append(blocked, message)
+			}
+		}
+		// No progress made, the rest is waiting on messages we don't have
+		if len(blocked) == len(remaining) {
+			break
+		}
+		remaining = blocked
+	}
+	return append(ordered, remaining...)
+}
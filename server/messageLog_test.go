@@ -0,0 +1,108 @@
+package main
+
+import "testing"
+
+func TestCausalOrder(t *testing.T) {
+	id := func(host string, clock int) MessageID { return MessageID{Host: host, Clock: clock} }
+	message := func(of MessageID, dependencies VectorClock, follows *MessageID) MessageFull {
+		return MessageFull{MessageBasic: MessageBasic{ID: of}, Dependencies: dependencies, Follows: follows}
+	}
+	for _, tc := range []struct {
+		name     string
+		base     VectorClock
+		messages []MessageFull
+		want     []MessageID
+	}{
+		{
+			name: "dependencies first",
+			messages: []MessageFull{
+				message(id("b", 1), VectorClock{"a": 2}, nil),
+				message(id("a", 2), VectorClock{"a": 1}, nil),
+				message(id("a", 1), nil, nil),
+			},
+			want: []MessageID{id("a", 1), id("a", 2), id("b", 1)},
+		},
+		{
+			name: "followed message first",
+			messages: []MessageFull{
+				message(id("a", 2), nil, &MessageID{Host: "a", Clock: 1}),
+				message(id("a", 1), nil, nil),
+			},
+			want: []MessageID{id("a", 1), id("a", 2)},
+		},
+		{
+			name: "followed message compacted away",
+			base: VectorClock{"a": 1},
+			messages: []MessageFull{
+				message(id("a", 2), nil, &MessageID{Host: "a", Clock: 1}),
+			},
+			want: []MessageID{id("a", 2)},
+		},
+		{
+			name: "missing dependency last",
+			messages: []MessageFull{
+				message(id("b", 1), VectorClock{"c": 1}, nil),
+				message(id("a", 1), nil, nil),
+			},
+			want: []MessageID{id("a", 1), id("b", 1)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := restoredMessageLog(tc.messages, tc.base)
+			got := log.causalOrder()
+			if len(got) != len(tc.want) {
+				t.Fatalf("got %d messages, want %d", len(got), len(tc.want))
+			}
+			for i, want := range tc.want {
+				if got[i].ID != want {
+					t.Errorf("message %d: got %s, want %s", i, got[i].ID.ToString(), want.ToString())
+				}
+			}
+		})
+	}
+}
+
+func TestMessageLogCompact(t *testing.T) {
+	id := func(host string, clock int) MessageID { return MessageID{Host: host, Clock: clock} }
+	chat := func(of MessageID) MessageFull { return MessageFull{MessageBasic: MessageBasic{ID: of}} }
+	for _, tc := range []struct {
+		name     string
+		messages []MessageID
+		frontier VectorClock
+		removed  int
+		kept     []MessageID
+	}{
+		{name: "nothing stable", messages: []MessageID{id("a", 0), id("b", 0)}, frontier: VectorClock{}, removed: 0, kept: []MessageID{id("a", 0), id("b", 0)}},
+		{name: "stable prefix", messages: []MessageID{id("a", 0), id("a", 1), id("a", 2)}, frontier: VectorClock{"a": 1}, removed: 2, kept: []MessageID{id("a", 2)}},
+		{name: "several hosts", messages: []MessageID{id("a", 0), id("b", 0), id("b", 1), id("a", 1)}, frontier: VectorClock{"a": 0, "b": 1}, removed: 3, kept: []MessageID{id("a", 1)}},
+		{name: "everything", messages: []MessageID{id("a", 0), id("b", 0)}, frontier: VectorClock{"a": 3, "b": 0}, removed: 2},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			log := newMessageLog()
+			for _, message := range tc.messages {
+				log.append(chat(message))
+			}
+			if removed := log.compact(tc.frontier); removed != tc.removed {
+				t.Fatalf("removed %d messages, want %d", removed, tc.removed)
+			}
+			got := log.causalOrder()
+			if len(got) != len(tc.kept) {
+				t.Fatalf("kept %d messages, want %d", len(got), len(tc.kept))
+			}
+			for i, want := range tc.kept {
+				if got[i].ID != want {
+					t.Errorf("message %d: got %s, want %s", i, got[i].ID.ToString(), want.ToString())
+				}
+			}
+			// What was compacted away is never taken back in, and still counts as had
+			for _, message := range tc.messages {
+				if tc.frontier.Includes(message) && log.append(chat(message)) {
+					t.Errorf("took back %s after compacting it", message.ToString())
+				}
+			}
+			if have, _ := log.summary(); !have.Dominates(tc.frontier) {
+				t.Errorf("summary %s doesn't cover what was compacted (%s)", have.ToString(), tc.frontier.ToString())
+			}
+		})
+	}
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestVectorClockCompare(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		a, b  VectorClock
+		order Ordering
+	}{
+		{name: "both empty", a: VectorClock{}, b: VectorClock{}, order: Equal},
+		{name: "equal", a: VectorClock{"x": 1, "y": 2}, b: VectorClock{"x": 1, "y": 2}, order: Equal},
+		{name: "behind on one host", a: VectorClock{"x": 1, "y": 2}, b: VectorClock{"x": 2, "y": 2}, order: Before},
+		{name: "missing a host", a: VectorClock{"x": 1}, b: VectorClock{"x": 1, "y": 0}, order: Before},
+		{name: "ahead", a: VectorClock{"x": 3, "y": 2}, b: VectorClock{"x": 1}, order: After},
+		{name: "concurrent", a: VectorClock{"x": 2, "y": 0}, b: VectorClock{"x": 1, "y": 1}, order: Concurrent},
+		{name: "disjoint hosts", a: VectorClock{"x": 0}, b: VectorClock{"y": 0}, order: Concurrent},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if got := tc.a.Compare(tc.b); got != tc.order {
+				t.Fatalf("%s compared to %s: got %s, want %s", tc.a.ToString(), tc.b.ToString(), got.ToString(), tc.order.ToString())
+			}
+			// The other way around the order is reversed
+			reversed := map[Ordering]Ordering{Equal: Equal, Before: After, After: Before, Concurrent: Concurrent}[tc.order]
+			if got := tc.b.Compare(tc.a); got != reversed {
+				t.Fatalf("%s compared to %s: got %s, want %s", tc.b.ToString(), tc.a.ToString(), got.ToString(), reversed.ToString())
+			}
+		})
+	}
+}
+
+func TestVectorClockMeet(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		a, b VectorClock
+		want VectorClock
+	}{
+		{name: "empty", a: VectorClock{}, b: VectorClock{"x": 1}, want: VectorClock{}},
+		{name: "minimum of each host", a: VectorClock{"x": 3, "y": 1}, b: VectorClock{"x": 1, "y": 4}, want: VectorClock{"x": 1, "y": 1}},
+		{name: "host only one has seen", a: VectorClock{"x": 3, "y": 1}, b: VectorClock{"x": 2}, want: VectorClock{"x": 2}},
+		{name: "same clocks", a: VectorClock{"x": 0, "y": 5}, b: VectorClock{"x": 0, "y": 5}, want: VectorClock{"x": 0, "y": 5}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			for _, meet := range []VectorClock{tc.a.Meet(tc.b), tc.b.Meet(tc.a)} {
+				if !reflect.DeepEqual(meet, tc.want) {
+					t.Fatalf("meet of %s and %s: got %s, want %s", tc.a.ToString(), tc.b.ToString(), meet.ToString(), tc.want.ToString())
+				}
+			}
+			// What both have seen comes before (or is) either of them
+			if order := tc.a.Meet(tc.b).Compare(tc.a); order != Before && order != Equal {
+				t.Fatalf("meet is %s %s", order.ToString(), tc.a.ToString())
+			}
+		})
+	}
+}
+
+func TestVectorClockIncrement(t *testing.T) {
+	for _, tc := range []struct {
+		name  string
+		clock VectorClock
+		host  string
+		want  MessageID
+	}{
+		// Clocks start at 0, -1 means nothing was seen
+		{name: "first event", clock: VectorClock{}, host: "x", want: MessageID{Host: "x", Clock: 0}},
+		{name: "next event", clock: VectorClock{"x": 4}, host: "x", want: MessageID{Host: "x", Clock: 5}},
+		{name: "other hosts untouched", clock: VectorClock{"x": 4, "y": 1}, host: "y", want: MessageID{Host: "y", Clock: 2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			before := tc.clock.Copy()
+			got := tc.clock.Increment(tc.host)
+			if got != tc.want {
+				t.Fatalf("got %s, want %s", got.ToString(), tc.want.ToString())
+			}
+			if !tc.clock.Includes(got) || tc.clock.Compare(before) != After {
+				t.Fatalf("clock %s doesn't include the new event %s", tc.clock.ToString(), got.ToString())
+			}
+			for host, clock := range before {
+				if host != tc.host && tc.clock[host] != clock {
+					t.Fatalf("%s moved from %d to %d", host, clock, tc.clock[host])
+				}
+			}
+		})
+	}
+}
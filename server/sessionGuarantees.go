@@ -0,0 +1,103 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// The session guarantees (Terry et al.) a client asks for in its handshake. Together
+// they make causal consistency, which is what a client gets unless it asks for less;
+// asking for less shows what each guarantee costs and which anomalies it prevents.
+// The client's state is split into its own writes and what it has observed (read or
+// been delivered):
+//
+//	ryw  read your writes: reads wait until the store has the client's own writes
+//	mr   monotonic reads: reads wait until the store has what the client observed,
+//	     and messages are only delivered once the client has observed what they
+//	     depend on
+//	wfr  writes follow reads: writes depend on what the client observed
+//	mw   monotonic writes: writes depend on the client's own earlier writes
+type sessionGuarantees struct {
+	readYourWrites    bool
+	monotonicReads    bool
+	writesFollowReads bool
+	monotonicWrites   bool
+}
+
+var causalGuarantees = sessionGuarantees{readYourWrites: true, monotonicReads: true, writesFollowReads: true, monotonicWrites: true}
+
+// Parses a comma separated list of guarantees, "none" is the empty list
+func parseGuarantees(list string) (sessionGuarantees, error) {
+	guarantees := sessionGuarantees{}
+	list = strings.TrimSpace(list)
+	if list == "none" {
+		return guarantees, nil
+	}
+	for _, name := range strings.Split(list, ",") {
+		switch strings.TrimSpace(name) {
+		case "ryw":
+			guarantees.readYourWrites = true
+		case "mr":
+			guarantees.monotonicReads = true
+		case "wfr":
+			guarantees.writesFollowReads = true
+		case "mw":
+			guarantees.monotonicWrites = true
+		default:
+			return guarantees, fmt.Errorf("unknown session guarantee %q (known: ryw, mr, wfr, mw)", name)
+		}
+	}
+	return guarantees, nil
+}
+
+func (guarantees sessionGuarantees) String() string {
+	names := []string{}
+	for name, set := range map[string]bool{"ryw": guarantees.readYourWrites, "mr": guarantees.monotonicReads, "wfr": guarantees.writesFollowReads, "mw": guarantees.monotonicWrites} {
+		if set {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return "none"
+	}
+	sort.Strings(names)
+	return strings.Join(names, ",")
+}
+
+// Splits the client's state into its own writes and what it has observed
+func splitState(state VectorClock, clientID string) (VectorClock, VectorClock) {
+	writes := VectorClock{}
+	observed := state.Copy()
+	if clock, found := state[clientID]; found {
+		writes[clientID] = clock
+		delete(observed, clientID)
+	}
+	return writes, observed
+}
+
+// What a read has to wait for the store to have
+func (guarantees sessionGuarantees) readContext(state VectorClock, clientID string) VectorClock {
+	writes, observed := splitState(state, clientID)
+	context := VectorClock{}
+	if guarantees.readYourWrites {
+		context.Merge(writes)
+	}
+	if guarantees.monotonicReads {
+		context.Merge(observed)
+	}
+	return context
+}
+
+// What a write depends on
+func (guarantees sessionGuarantees) writeDependencies(state VectorClock, clientID string) VectorClock {
+	writes, observed := splitState(state, clientID)
+	dependencies := VectorClock{}
+	if guarantees.monotonicWrites {
+		dependencies.Merge(writes)
+	}
+	if guarantees.writesFollowReads {
+		dependencies.Merge(observed)
+	}
+	return dependencies
+}
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// A snapshot of a datacenter, taken periodically so that the write-ahead log doesn't
+// grow forever: once it is on disk the log segments before NextSegment are deleted.
+// Recovering loads the snapshot, then replays the segments from NextSegment on
+type snapshot struct {
+	Taken time.Time
+	// The first log segment that isn't covered by the snapshot
+	NextSegment int
+	// What every client had seen
+	Clients map[string]VectorClock
+	// The broker's history, in causal order. Those the store hasn't committed are
+	// still pending, waiting in staging for their dependencies
+	Messages []MessageFull
+	// What was compacted away from the history, being stable
+	Compacted VectorClock
+	Store     storeSnapshot
+}
+
+// What the store had committed
+type storeSnapshot struct {
+	Visible     VectorClock
+	Versions    map[string][]Version
+	Objects     map[string]crdtSnapshot
+	LastOps     map[string]MessageID
+	ObjectPasts map[string]VectorClock
+	Pasts       []messagePast
+}
+
+// A CRDT object and its type, which is needed to decode it
+type crdtSnapshot struct {
+	Type  string
+	State json.RawMessage
+}
+
+// The full causal past of a committed message
+type messagePast struct {
+	ID   MessageID
+	Past VectorClock
+}
+
+// Returns the messages of the snapshot that the store hadn't committed
+func (snap *snapshot) pending() []MessageFull {
+	pending := []MessageFull{}
+	for _, message := range snap.Messages {
+		if !snap.Store.Visible.Includes(message.ID) {
+			pending = append(pending, message)
+		}
+	}
+	return pending
+}
+
+// Loads the snapshot at path, nil if there is none yet
+func loadSnapshot(path string) (*snapshot, error) {
+	encoded, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var snap snapshot
+	if err := json.Unmarshal(encoded, &snap); err != nil {
+		return nil, fmt.Errorf("corrupt snapshot %s: %w", path, err)
+	}
+	return &snap, nil
+}
+
+// Writes the snapshot to path. It is written next to it first and then renamed, so a
+// crash can't leave half a snapshot behind
+func (snap *snapshot) save(path string) error {
+	encoded, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	file, err := os.Create(path + ".tmp")
+	if err != nil {
+		return err
+	}
+	if _, err := file.Write(encoded); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	if err := file.Close(); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// A request for a snapshot of the broker's history. With checkpoint the log starts a
+// new segment at the snapshot, so the segments before it can be deleted once the
+// snapshot is on disk. A snapshot that isn't saved doesn't need one
+type snapshotRequest struct {
+	checkpoint bool
+	reply      chan snapshot
+}
+
+// Takes a snapshot every interval and compacts the log. The store's state is taken
+// first and then the broker's history (together with a checkpoint of the log), so
+// everything the store has committed is in the history and everything in the history
+// is in the segments the snapshot covers
+func snapshotter(path string, interval time.Duration, wal *writeAheadLog, storeSnapshots chan<- chan storeSnapshot, brokerSnapshots chan<- snapshotRequest) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		snap := takeSnapshot(storeSnapshots, brokerSnapshots, true)
+		if err := snap.save(path); err != nil {
+			fmt.Println("Couldn't save snapshot", err)
+			continue
+		}
+		fmt.Println("Snapshot saved:", len(snap.Messages), "messages,", len(snap.Clients), "clients, log continues at segment", snap.NextSegment)
+		wal.removeSegmentsBefore(snap.NextSegment)
+	}
+}
+
+// Takes a snapshot of the store and then of the broker's history, with a checkpoint
+// of the log if asked for
+func takeSnapshot(storeSnapshots chan<- chan storeSnapshot, brokerSnapshots chan<- snapshotRequest, checkpoint bool) snapshot {
+	storeReply := make(chan storeSnapshot)
+	storeSnapshots <- storeReply
+	store := <-storeReply
+
+	brokerReply := make(chan snapshot)
+	brokerSnapshots <- snapshotRequest{checkpoint: checkpoint, reply: brokerReply}
+	snap := <-brokerReply
+	snap.Taken = time.Now()
+	snap.Store = store
+	return snap
+}
+
+// Prints what a snapshot file holds
+func inspectSnapshot(path string, resolver ConflictResolver) error {
+	snap, err := loadSnapshot(path)
+	if err != nil {
+		return err
+	}
+	if snap == nil {
+		return fmt.Errorf("no snapshot at %s", path)
+	}
+	fmt.Println("Taken:", snap.Taken.Format(time.RFC3339))
+	fmt.Println("Log continues at segment:", snap.NextSegment)
+	fmt.Println("Committed:", snap.Store.Visible.ToString())
+	fmt.Println("Compacted away from the history:", snap.Compacted.ToString())
+
+	clients := []string{}
+	for client := range snap.Clients {
+		clients = append(clients, client)
+	}
+	sort.Strings(clients)
+	fmt.Println("Clients:", len(clients))
+	for _, client := range clients {
+		fmt.Println("\t"+client, "has seen", snap.Clients[client].ToString())
+	}
+
+	keys := []string{}
+	for key := range snap.Store.Versions {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	fmt.Println("Keys:", len(keys))
+	for _, key := range keys {
+		versions := snap.Store.Versions[key]
+		for _, version := range versionsAt(key, versions, nil, resolver) {
+			fmt.Println("\t"+key, "=", string(version.Value), "("+version.ID.ToString()+",", len(versions), "versions)")
+		}
+	}
+
+	objects := []string{}
+	for name := range snap.Store.Objects {
+		objects = append(objects, name)
+	}
+	sort.Strings(objects)
+	fmt.Println("Objects:", len(objects))
+	for _, name := range objects {
+		object, err := snap.Store.Objects[name].restore()
+		if err != nil {
+			fmt.Println("\t"+name, "can't be read:", err)
+			continue
+		}
+		fmt.Println("\t"+name, "("+snap.Store.Objects[name].Type+") =", object.Value())
+	}
+
+	pending := snap.pending()
+	fmt.Println("Messages:", len(snap.Messages), "of which", len(pending), "pending")
+	for _, message := range pending {
+		fmt.Println("\t"+message.MessageBasic.ToString(), "waiting for", message.Dependencies.ToString())
+	}
+	return nil
+}
+
+func newCrdtSnapshot(typeName string, object CRDT) (crdtSnapshot, error) {
+	state, err := json.Marshal(object)
+	return crdtSnapshot{Type: typeName, State: state}, err
+}
+
+func (object crdtSnapshot) restore() (CRDT, error) {
+	restored, err := newCRDT(object.Type)
+	if err != nil {
+		return nil, err
+	}
+	return restored, json.Unmarshal(object.State, restored)
+}
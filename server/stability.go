@@ -0,0 +1,172 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A message is stable once every datacenter has applied it (its store has committed
+// it). Nobody can still be waiting for a stable message, so it no longer needs to be
+// kept for retransmission or in the broker's history.
+//
+// Datacenters acknowledge what they have applied with a vector clock (which covers
+// everything applied, not just one message) that they keep sending to each other,
+// along with the clocks they heard from others so that datacenters that aren't linked
+// directly hear of each other. The stable frontier is the element-wise minimum of the
+// clocks of all datacenters. Stores commit in causal order, so the frontier is causally
+// closed too
+type stabilityUpdate struct {
+	// What this datacenter has applied
+	Applied VectorClock
+	// What every datacenter has applied
+	Stable VectorClock
+	// What each datacenter is known to have applied
+	Known map[string]VectorClock
+}
+
+// Tracks what every datacenter (every member, as members come and go) has applied.
+// Returns a function that subscribes to updates and one that reports what a datacenter
+// has applied. Subscribers only ever get the latest update: one that hasn't been
+// received yet is replaced by the next, so a busy subscriber never holds the tracker
+// up. Reports that bring nothing new don't make an update, so gossip dies down once
+// everyone is up to date
+func stabilityTracker(local string, members <-chan memberView) (func() chan stabilityUpdate, func(string, VectorClock)) {
+	type report struct {
+		datacenter string
+		applied    VectorClock
+	}
+	reports := make(chan report, 100)
+	addSubscriber := make(chan chan stabilityUpdate, 5)
+
+	go func() {
+		applied := map[string]VectorClock{}
+		latest := stabilityUpdate{Applied: VectorClock{}, Stable: VectorClock{}, Known: map[string]VectorClock{}}
+		subscribers := []chan stabilityUpdate{}
+		publish := func(subscriber chan stabilityUpdate) {
+			select {
+			case <-subscriber:
+			default:
+			}
+			known := map[string]VectorClock{}
+			for datacenter, clock := range latest.Known {
+				known[datacenter] = clock.Copy()
+			}
+			subscriber <- stabilityUpdate{Applied: latest.Applied.Copy(), Stable: latest.Stable.Copy(), Known: known}
+		}
+		update := func() {
+			stable := stableFrontier(applied)
+			if stable.Compare(latest.Stable) == After {
+				fmt.Println("Stability-stable frontier is now", stable.ToString())
+			}
+			latest = stabilityUpdate{Applied: applied[local].Copy(), Stable: stable, Known: map[string]VectorClock{}}
+			for datacenter, clock := range applied {
+				if clock != nil {
+					latest.Known[datacenter] = clock
+				}
+			}
+			for _, subscriber := range subscribers {
+				publish(subscriber)
+			}
+		}
+		for {
+			select {
+			case newSub := <-addSubscriber:
+				subscribers = append(subscribers, newSub)
+				publish(newSub)
+			case view := <-members:
+				// A datacenter that joined holds the frontier back until it reports, one
+				// that left no longer does
+				current := map[string]bool{}
+				for _, datacenter := range view.members() {
+					current[datacenter] = true
+					if _, found := applied[datacenter]; !found {
+						applied[datacenter] = nil
+					}
+				}
+				for datacenter := range applied {
+					if !current[datacenter] {
+						delete(applied, datacenter)
+					}
+				}
+				update()
+			case r := <-reports:
+				known, found := applied[r.datacenter]
+				if !found {
+					fmt.Println("Stability-ignoring unknown datacenter", r.datacenter)
+					continue
+				}
+				if known == nil {
+					known = VectorClock{}
+					applied[r.datacenter] = known
+				} else if known.Dominates(r.applied) {
+					continue
+				}
+				known.Merge(r.applied)
+				update()
+			}
+		}
+	}()
+
+	subscribe := func() chan stabilityUpdate {
+		subscriber := make(chan stabilityUpdate, 1)
+		addSubscriber <- subscriber
+		return subscriber
+	}
+	reportApplied := func(datacenter string, clock VectorClock) {
+		reports <- report{datacenter: datacenter, applied: clock}
+	}
+	return subscribe, reportApplied
+}
+
+// What every datacenter has applied. Nothing is stable until every datacenter has
+// reported
+func stableFrontier(applied map[string]VectorClock) VectorClock {
+	var stable VectorClock
+	for _, clock := range applied {
+		if clock == nil {
+			return VectorClock{}
+		}
+		if stable == nil {
+			stable = clock.Copy()
+		} else {
+			stable = stable.Meet(clock)
+		}
+	}
+	if stable == nil {
+		return VectorClock{}
+	}
+	return stable
+}
+
+// Stable frontiers, oldest first, waiting out a retention period before what they
+// include is thrown away. Keeping stable messages for a while longer gives whoever
+// is still catching up (a client replaying the history, a concurrency check on a
+// message that depends on an old one) a chance to use them
+type retainedFrontiers struct {
+	retention time.Duration
+	observed  []observedFrontier
+}
+
+type observedFrontier struct {
+	at     time.Time
+	stable VectorClock
+}
+
+// Records the stable frontier of an update, if it moved forward
+func (frontiers *retainedFrontiers) observe(stable VectorClock) {
+	observed := frontiers.observed
+	if len(observed) == 0 || stable.Compare(observed[len(observed)-1].stable) == After {
+		frontiers.observed = append(observed, observedFrontier{at: time.Now(), stable: stable})
+	}
+}
+
+// Returns the newest frontier that has waited out the retention (nil if there is
+// none) and forgets it along with the older ones
+func (frontiers *retainedFrontiers) due() VectorClock {
+	var frontier VectorClock
+	for len(frontiers.observed) > 0 && time.Since(frontiers.observed[0].at) >= frontiers.retention {
+		frontier = frontiers.observed[0].stable
+		frontiers.observed = frontiers.observed[1:]
+	}
+	return frontier
+}
@@ -0,0 +1,274 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// Limits of a staging area. A dependency that never arrives (e.g. its datacenter is
+// down) would otherwise make the queue grow without bound
+type stagingConfig struct {
+	// How many waiting messages are kept in memory, the rest is spilled to disk
+	memoryLimit int
+	// Where spill files go
+	spillDir string
+	// Messages waiting longer than this are dropped, 0 keeps them forever. Only
+	// clients' staging areas should expire messages: the store must commit everything
+	// to converge with the other datacenters
+	expireAfter time.Duration
+	// Messages waiting longer than this are reported as stuck
+	stuckAfter time.Duration
+	// Release messages without waiting for their dependencies (for clients that
+	// didn't ask for monotonic reads)
+	ignoreDependencies bool
+	// Also wait for the message a message follows (see MessageFull.Follows), so that
+	// every client's messages are released in the order they were sent. A state only
+	// records the last message seen from each host, releasing a message ahead of the
+	// ones its sender sent before would take those as seen too
+	writerOrder bool
+}
+
+// A message waiting in staging. Spilled messages only keep their place in the spill
+// file in memory
+type stagedMessage struct {
+	message *MessageFull
+	offset  int64
+	length  int
+	since   time.Time
+}
+
+// An append-only file of spilled messages. It is removed once nothing in it is
+// waiting anymore. Staging areas are named after clients, which pick their own ids,
+// so the file gets its name from the OS instead
+type spillFile struct {
+	dir  string
+	file *os.File
+	size int64
+}
+
+func (spill *spillFile) write(message MessageFull) (int64, int, error) {
+	if spill.file == nil {
+		file, err := os.CreateTemp(spill.dir, "staging-*.spill")
+		if err != nil {
+			return 0, 0, err
+		}
+		spill.file = file
+		spill.size = 0
+	}
+	encoded, err := json.Marshal(message)
+	if err != nil {
+		return 0, 0, err
+	}
+	offset := spill.size
+	if _, err := spill.file.WriteAt(encoded, offset); err != nil {
+		return 0, 0, err
+	}
+	spill.size += int64(len(encoded))
+	return offset, len(encoded), nil
+}
+
+func (spill *spillFile) read(offset int64, length int) (MessageFull, error) {
+	var message MessageFull
+	encoded := make([]byte, length)
+	if _, err := spill.file.ReadAt(encoded, offset); err != nil {
+		return message, err
+	}
+	err := json.Unmarshal(encoded, &message)
+	return message, err
+}
+
+func (spill *spillFile) clear() {
+	if spill.file != nil {
+		spill.file.Close()
+		os.Remove(spill.file.Name())
+		spill.file = nil
+	}
+}
+
+// Holds messages until everything they depend on has been seen (by the client, or
+// committed by the store), then passes them on to messagesReady in causal order.
+// Every staged message is indexed by the one dependency it is waiting on, so a change
+// of state only wakes up the messages it can unblock instead of rescanning the whole
+// queue. Releasing a message may unblock others in turn; that cascade is followed
+// right away rather than waiting for the state manager to report the delivery.
+// Beyond config.memoryLimit, waiting messages are spilled to disk and read back when
+// they are woken up, name only shows up in the log. Once done is closed (nil never
+// closes) nothing is released anymore, availableMessages is drained until the broker
+// closes it
+func clientStaging(name string, config stagingConfig, availableMessages <-chan MessageFull, clientStateChan <-chan VectorClock, messagesReady chan<- MessageFull, done <-chan struct{}) {
+	clientState := <-clientStateChan
+	// What was seen before staging started (in an earlier session). The broker
+	// passes on every message once, so nothing else comes twice
+	seenBefore := clientState.Copy()
+	// waiting[host][clock] holds the messages waiting for host{clock}, clocks[host]
+	// the clocks waited on for host in increasing order, so a host moving forward
+	// only looks at the clocks it reached
+	waiting := map[string]map[int][]stagedMessage{}
+	clocks := map[string][]int{}
+	inMemory := 0
+	spilled := 0
+	spill := &spillFile{dir: config.spillDir}
+	// The writes of a transaction are released together once all of them are ready,
+	// so nothing can be released in between that depends on part of it
+	assemble := txAssembler()
+	// Hosts whose entry in the state moved forward, so whatever waits on them
+	// needs another look
+	advanced := []string{}
+
+	// Releases the message, or indexes it by the first dependency it is missing.
+	// Messages that were already seen (in an earlier session) are dropped
+	stage := func(message MessageFull, since time.Time) {
+		if seenBefore.Includes(message.ID) {
+			return
+		}
+		waitsFor := message.Dependencies
+		if config.ignoreDependencies {
+			waitsFor = nil
+		}
+		if config.writerOrder && message.Follows != nil {
+			waitsFor = waitsFor.Copy()
+			waitsFor.Witness(*message.Follows)
+		}
+		for host, clock := range waitsFor {
+			if clientState.Get(host) >= clock {
+				continue
+			}
+			staged := stagedMessage{message: &message, since: since}
+			if inMemory >= config.memoryLimit {
+				offset, length, err := spill.write(message)
+				if err == nil {
+					staged = stagedMessage{offset: offset, length: length, since: since}
+					spilled++
+				} else {
+					fmt.Println("Staging-couldn't spill, keeping in memory", err)
+				}
+			}
+			if staged.message != nil {
+				inMemory++
+			}
+			if waiting[host] == nil {
+				waiting[host] = map[int][]stagedMessage{}
+			}
+			if _, found := waiting[host][clock]; !found {
+				at := sort.SearchInts(clocks[host], clock)
+				clocks[host] = append(clocks[host], 0)
+				copy(clocks[host][at+1:], clocks[host][at:])
+				clocks[host][at] = clock
+			}
+			waiting[host][clock] = append(waiting[host][clock], staged)
+			fmt.Println("Staging-waiting for", MessageID{Host: host, Clock: clock}.ToString(), "to release", message.ID.ToString())
+			return
+		}
+		for _, ready := range assemble(message) {
+			select {
+			case messagesReady <- ready:
+			case <-done:
+				return
+			}
+			clientState.Witness(ready.ID)
+			advanced = append(advanced, ready.ID.Host)
+		}
+	}
+
+	// Takes a message out of the index, reading it back if it was spilled
+	unstage := func(staged stagedMessage) (MessageFull, bool) {
+		if staged.message != nil {
+			inMemory--
+			return *staged.message, true
+		}
+		spilled--
+		message, err := spill.read(staged.offset, staged.length)
+		if spilled == 0 {
+			spill.clear()
+		}
+		if err != nil {
+			fmt.Println("Staging-lost a spilled message", err)
+			return message, false
+		}
+		return message, true
+	}
+
+	// Re-stages the messages waiting on hosts that moved forward, until the
+	// cascade runs out
+	wakeUp := func() {
+		for len(advanced) > 0 {
+			host := advanced[0]
+			advanced = advanced[1:]
+			for len(clocks[host]) > 0 && clocks[host][0] <= clientState.Get(host) {
+				clock := clocks[host][0]
+				clocks[host] = clocks[host][1:]
+				messages := waiting[host][clock]
+				delete(waiting[host], clock)
+				for _, staged := range messages {
+					if message, ok := unstage(staged); ok {
+						stage(message, staged.since)
+					}
+				}
+			}
+		}
+	}
+
+	// Reports how many messages are stuck and drops the expired ones
+	checkStuck := func() {
+		now := time.Now()
+		stuck := 0
+		for host, byClock := range waiting {
+			for clock, messages := range byClock {
+				kept := []stagedMessage{}
+				for _, staged := range messages {
+					age := now.Sub(staged.since)
+					if config.expireAfter > 0 && age > config.expireAfter {
+						if message, ok := unstage(staged); ok {
+							fmt.Println("Staging-"+name+": dropping", message.ID.ToString(), "after waiting", age.Round(time.Second), "for", MessageID{Host: host, Clock: clock}.ToString())
+						}
+						continue
+					}
+					if age > config.stuckAfter {
+						stuck++
+					}
+					kept = append(kept, staged)
+				}
+				if len(kept) == 0 {
+					delete(byClock, clock)
+					at := sort.SearchInts(clocks[host], clock)
+					clocks[host] = append(clocks[host][:at], clocks[host][at+1:]...)
+				} else {
+					byClock[clock] = kept
+				}
+			}
+		}
+		if stuck > 0 {
+			fmt.Println("Staging-"+name+":", stuck, "messages stuck for more than", config.stuckAfter, "-", inMemory, "in memory,", spilled, "spilled to disk")
+		}
+	}
+	stuckTicker := time.NewTicker(config.stuckAfter)
+	defer stuckTicker.Stop()
+
+	for {
+		select {
+		case message := <-availableMessages:
+			fmt.Println("Staging-new message: ", message.ToString())
+			stage(message, time.Now())
+			wakeUp()
+		case cs := <-clientStateChan:
+			fmt.Println("Staging-New state: ", cs.ToString())
+			for host, clock := range cs {
+				if clock > clientState.Get(host) {
+					advanced = append(advanced, host)
+				}
+			}
+			clientState.Merge(cs)
+			wakeUp()
+		case <-stuckTicker.C:
+			checkStuck()
+		case <-done:
+			for range availableMessages {
+			}
+			spill.clear()
+			return
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// A backlog waiting on a single dependency is released in one cascade while the
+// store (simulated here) updates the state that staging subscribes to for every
+// message it commits. Neither may wait on the other however long the cascade is
+func TestStagingReleasesLargeBacklogToStore(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		waiting int
+		spill   int
+	}{
+		{"small", 150, 1000},
+		{"channel sized", 300, 1000},
+		{"large", 500, 1000},
+		{"larger than memory", 1000, 100},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			csSubscribeFn, csUpdateFn := clientSateManager(VectorClock{}, nil)
+			available := make(chan MessageFull, 100)
+			committable := make(chan MessageFull, 100)
+			config := stagingConfig{memoryLimit: tc.spill, spillDir: t.TempDir(), stuckAfter: time.Minute, writerOrder: true}
+			go clientStaging("test", config, available, csSubscribeFn(), committable, nil)
+
+			committed := make(chan int)
+			go func() {
+				count := 0
+				for message := range committable {
+					csUpdateFn(message.ID)
+					count++
+					if count == tc.waiting+1 {
+						committed <- count
+					}
+				}
+			}()
+
+			for clock := 1; clock <= tc.waiting; clock++ {
+				available <- MessageFull{
+					MessageBasic: MessageBasic{ID: MessageID{Host: "a", Clock: clock}, Kind: PutMessage, Key: "k"},
+					Dependencies: VectorClock{"b": 1},
+				}
+			}
+			available <- MessageFull{MessageBasic: MessageBasic{ID: MessageID{Host: "b", Clock: 1}, Kind: PutMessage, Key: "k"}}
+
+			select {
+			case count := <-committed:
+				if count != tc.waiting+1 {
+					t.Fatalf("committed %d messages, want %d", count, tc.waiting+1)
+				}
+			case <-time.After(10 * time.Second):
+				t.Fatalf("the backlog of %d messages was never committed", tc.waiting)
+			}
+		})
+	}
+}
+
+// Messages are only released once what they wait on (dependencies, and the writer's
+// previous message when writer order is kept) has been released
+func TestStagingOrder(t *testing.T) {
+	a := func(clock int) MessageID { return MessageID{Host: "a", Clock: clock} }
+	for _, tc := range []struct {
+		name        string
+		writerOrder bool
+		ignoreDeps  bool
+		in          []MessageFull
+		want        []MessageID
+	}{
+		{
+			name: "dependencies first",
+			in: []MessageFull{
+				{MessageBasic: MessageBasic{ID: a(2)}, Dependencies: VectorClock{"a": 1}},
+				{MessageBasic: MessageBasic{ID: MessageID{Host: "b", Clock: 1}}, Dependencies: VectorClock{"a": 2}},
+				{MessageBasic: MessageBasic{ID: a(1)}},
+			},
+			want: []MessageID{a(1), a(2), {Host: "b", Clock: 1}},
+		},
+		{
+			name:        "writer order without dependencies",
+			writerOrder: true,
+			ignoreDeps:  true,
+			in: []MessageFull{
+				{MessageBasic: MessageBasic{ID: a(3)}, Follows: &MessageID{Host: "a", Clock: 2}},
+				{MessageBasic: MessageBasic{ID: a(2)}, Follows: &MessageID{Host: "a", Clock: 1}},
+				{MessageBasic: MessageBasic{ID: a(1)}},
+			},
+			want: []MessageID{a(1), a(2), a(3)},
+		},
+		{
+			name:       "no order at all",
+			ignoreDeps: true,
+			in: []MessageFull{
+				{MessageBasic: MessageBasic{ID: a(2)}, Dependencies: VectorClock{"a": 1}},
+				{MessageBasic: MessageBasic{ID: a(1)}},
+			},
+			want: []MessageID{a(2), a(1)},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			csSubscribeFn, csUpdateFn := clientSateManager(VectorClock{}, nil)
+			available := make(chan MessageFull, len(tc.in))
+			ready := make(chan MessageFull, len(tc.in))
+			config := stagingConfig{memoryLimit: 100, spillDir: t.TempDir(), stuckAfter: time.Minute, writerOrder: tc.writerOrder, ignoreDependencies: tc.ignoreDeps}
+			go clientStaging("test", config, available, csSubscribeFn(), ready, nil)
+			for _, message := range tc.in {
+				available <- message
+			}
+			for i, want := range tc.want {
+				select {
+				case got := <-ready:
+					csUpdateFn(got.ID)
+					if got.ID != want {
+						t.Fatalf("message %d: got %s, want %s", i, got.ID.ToString(), want.ToString())
+					}
+				case <-time.After(5 * time.Second):
+					t.Fatalf("message %d (%s) was never released", i, want.ToString())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,293 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The write-ahead log lets a datacenter survive a crash. Every message the broker
+// accepts and every message a client has seen is appended to it (and synced) before
+// it goes any further. At startup the log is replayed on top of the latest snapshot:
+// the broker gets its history back, the store and the clients' staging areas rebuild
+// from that history, and a client that reconnects picks up the state it had.
+//
+// The log is split into numbered segments (path.000001, ...). A checkpoint starts a
+// new segment, so once a snapshot taken at the checkpoint is on disk every earlier
+// segment can be deleted
+type writeAheadLog struct {
+	path        string
+	appends     chan walAppend
+	states      chan walStateRequest
+	checkpoints chan chan walCheckpoint
+	// The messages found in the snapshot and the log at startup, in the order they
+	// were accepted, and what the snapshot's history had compacted away
+	recovered []MessageFull
+	compacted VectorClock
+}
+
+// One line of the log: either a message accepted by the broker or a message seen by
+// a client
+type walRecord struct {
+	Message *MessageFull `json:",omitempty"`
+	Client  string       `json:",omitempty"`
+	Seen    *MessageID   `json:",omitempty"`
+}
+
+type walAppend struct {
+	record walRecord
+	// Closed once the record is on disk
+	done chan struct{}
+}
+
+type walStateRequest struct {
+	client string
+	reply  chan VectorClock
+}
+
+// Where a checkpoint was taken: the segment the log continues in, and what every
+// client had seen up to there
+type walCheckpoint struct {
+	segment int
+	clients map[string]VectorClock
+}
+
+// Opens the log at path (creating it if needed) and replays it on top of from, the
+// latest snapshot (nil if there is none). Segments the snapshot covers are deleted and
+// a record torn by a crash in the middle of writing it is cut off. Appends go to a
+// new segment
+func openWriteAheadLog(path string, from *snapshot) (*writeAheadLog, error) {
+	wal := &writeAheadLog{
+		path:        path,
+		appends:     make(chan walAppend, 100),
+		states:      make(chan walStateRequest),
+		checkpoints: make(chan chan walCheckpoint),
+	}
+	// What every client has seen
+	clients := map[string]VectorClock{}
+	first := 0
+	if from != nil {
+		first = from.NextSegment
+		wal.recovered = append(wal.recovered, from.Messages...)
+		wal.compacted = from.Compacted
+		for client, state := range from.Clients {
+			clients[client] = state.Copy()
+		}
+	}
+	wal.removeSegmentsBefore(first)
+
+	segments, err := wal.segments()
+	if err != nil {
+		return nil, err
+	}
+	last := first - 1
+	for _, segment := range segments {
+		records, err := readSegment(wal.segmentPath(segment))
+		if err != nil {
+			return nil, err
+		}
+		for _, record := range records {
+			if record.Message != nil {
+				wal.recovered = append(wal.recovered, *record.Message)
+			}
+			if record.Seen != nil {
+				if clients[record.Client] == nil {
+					clients[record.Client] = VectorClock{}
+				}
+				clients[record.Client].Witness(*record.Seen)
+			}
+		}
+		last = segment
+	}
+	fmt.Println("WAL-recovered", len(wal.recovered), "messages and the states of", len(clients), "clients from", path)
+
+	file, err := os.OpenFile(wal.segmentPath(last+1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+	go wal.run(file, last+1, clients)
+	return wal, nil
+}
+
+func (wal *writeAheadLog) segmentPath(segment int) string {
+	return fmt.Sprintf("%s.%06d", wal.path, segment)
+}
+
+// Returns the numbers of the segments on disk, in order
+func (wal *writeAheadLog) segments() ([]int, error) {
+	paths, err := filepath.Glob(wal.path + ".*")
+	if err != nil {
+		return nil, err
+	}
+	segments := []int{}
+	for _, path := range paths {
+		segment, err := strconv.Atoi(strings.TrimPrefix(path, wal.path+"."))
+		if err == nil {
+			segments = append(segments, segment)
+		}
+	}
+	sort.Ints(segments)
+	return segments, nil
+}
+
+// Deletes the segments before segment, a snapshot covers them
+func (wal *writeAheadLog) removeSegmentsBefore(segment int) {
+	segments, err := wal.segments()
+	if err != nil {
+		fmt.Println("WAL-couldn't list segments", err)
+		return
+	}
+	for _, old := range segments {
+		if old >= segment {
+			break
+		}
+		if err := os.Remove(wal.segmentPath(old)); err != nil {
+			fmt.Println("WAL-couldn't remove segment", old, err)
+		} else {
+			fmt.Println("WAL-removed segment", old)
+		}
+	}
+}
+
+// Reads the records of a segment, cutting off a torn one at the end
+func readSegment(path string) ([]walRecord, error) {
+	file, err := os.OpenFile(path, os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	records := []walRecord{}
+	reader := bufio.NewReader(file)
+	var good int64 = 0
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF && len(line) == 0 {
+			return records, nil
+		}
+		var record walRecord
+		if err != nil || json.Unmarshal(line, &record) != nil {
+			fmt.Println("WAL-cutting off a torn record in", path, "at offset", good)
+			return records, file.Truncate(good)
+		}
+		good += int64(len(line))
+		records = append(records, record)
+	}
+}
+
+// Owns the current segment and the clients' states. Records that pile up while the
+// file is synced are written together and synced once
+func (wal *writeAheadLog) run(file *os.File, segment int, clients map[string]VectorClock) {
+	writer := bufio.NewWriter(file)
+	for {
+		select {
+		case first := <-wal.appends:
+			batch := []walAppend{first}
+			for more := true; more; {
+				select {
+				case next := <-wal.appends:
+					batch = append(batch, next)
+				default:
+					more = false
+				}
+			}
+			for _, pending := range batch {
+				encoded, err := json.Marshal(pending.record)
+				if err != nil {
+					fmt.Println("WAL-couldn't encode a record", err)
+					continue
+				}
+				writer.Write(append(encoded, '\n'))
+				if pending.record.Seen != nil {
+					if clients[pending.record.Client] == nil {
+						clients[pending.record.Client] = VectorClock{}
+					}
+					clients[pending.record.Client].Witness(*pending.record.Seen)
+				}
+			}
+			if err := writer.Flush(); err != nil {
+				fmt.Println("WAL-couldn't write", err)
+			} else if err := file.Sync(); err != nil {
+				fmt.Println("WAL-couldn't sync", err)
+			}
+			for _, pending := range batch {
+				close(pending.done)
+			}
+		case request := <-wal.states:
+			request.reply <- clients[request.client].Copy()
+		case reply := <-wal.checkpoints:
+			// Everything so far stays in the segments before the new one
+			next, err := os.OpenFile(wal.segmentPath(segment+1), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+			if err != nil {
+				fmt.Println("WAL-couldn't start a new segment", err)
+			} else {
+				file.Close()
+				file = next
+				writer = bufio.NewWriter(file)
+				segment++
+			}
+			copied := map[string]VectorClock{}
+			for client, state := range clients {
+				copied[client] = state.Copy()
+			}
+			reply <- walCheckpoint{segment: segment, clients: copied}
+		}
+	}
+}
+
+// Appends the record and waits until it is on disk. Without a log (nil) there is
+// nothing to do
+func (wal *writeAheadLog) append(record walRecord) {
+	if wal == nil {
+		return
+	}
+	done := make(chan struct{})
+	wal.appends <- walAppend{record: record, done: done}
+	<-done
+}
+
+// Logs a message accepted by the broker
+func (wal *writeAheadLog) logMessage(message MessageFull) {
+	wal.append(walRecord{Message: &message})
+}
+
+// Logs that the client has seen the message id
+func (wal *writeAheadLog) logSeen(client string, id MessageID) {
+	wal.append(walRecord{Client: client, Seen: &id})
+}
+
+// Returns what the client had seen, according to the log
+func (wal *writeAheadLog) clientState(client string) VectorClock {
+	if wal == nil {
+		return VectorClock{}
+	}
+	reply := make(chan VectorClock)
+	wal.states <- walStateRequest{client: client, reply: reply}
+	return <-reply
+}
+
+// Starts a new segment. Whatever is logged from now on goes to the returned segment
+// or later ones. Without a log there is no segment to start
+func (wal *writeAheadLog) checkpoint() walCheckpoint {
+	if wal == nil {
+		return walCheckpoint{}
+	}
+	reply := make(chan walCheckpoint)
+	wal.checkpoints <- reply
+	return <-reply
+}
+
+// Returns the messages found in the snapshot and the log at startup, and what had been
+// compacted away before them
+func (wal *writeAheadLog) recoveredHistory() ([]MessageFull, VectorClock) {
+	if wal == nil {
+		return nil, nil
+	}
+	return wal.recovered, wal.compacted
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// What was logged comes back when the log is opened again, on top of the snapshot it
+// was opened with
+func TestWriteAheadLogRecovery(t *testing.T) {
+	message := func(clock int) MessageFull {
+		return MessageFull{MessageBasic: MessageBasic{ID: MessageID{Host: "a", Clock: clock}, Kind: ChatMessage, Body: []byte("hi")}}
+	}
+	for _, tc := range []struct {
+		name string
+		// Logs to wal, returns the snapshot to open the log again with
+		write func(wal *writeAheadLog) *snapshot
+		// Leaves half a record at the end of the last segment, as a crash while
+		// writing it would
+		torn          bool
+		wantMessages  []MessageFull
+		wantCompacted VectorClock
+		wantSeen      VectorClock
+		// The segments on disk once the log is open again
+		wantSegments []int
+	}{
+		{
+			name: "nothing logged",
+			write: func(wal *writeAheadLog) *snapshot {
+				return nil
+			},
+			wantSeen:     VectorClock{},
+			wantSegments: []int{0, 1},
+		},
+		{
+			name: "every segment replayed",
+			write: func(wal *writeAheadLog) *snapshot {
+				wal.logMessage(message(0))
+				wal.logSeen("client", message(0).ID)
+				wal.checkpoint()
+				wal.logMessage(message(1))
+				wal.logSeen("client", message(1).ID)
+				return nil
+			},
+			wantMessages: []MessageFull{message(0), message(1)},
+			wantSeen:     VectorClock{"a": 1},
+			wantSegments: []int{0, 1, 2},
+		},
+		{
+			name: "torn record cut off",
+			write: func(wal *writeAheadLog) *snapshot {
+				wal.logMessage(message(0))
+				wal.logSeen("client", message(0).ID)
+				return nil
+			},
+			torn:         true,
+			wantMessages: []MessageFull{message(0)},
+			wantSeen:     VectorClock{"a": 0},
+			wantSegments: []int{0, 1},
+		},
+		{
+			name: "segments before the snapshot removed",
+			write: func(wal *writeAheadLog) *snapshot {
+				wal.logMessage(message(0))
+				wal.logSeen("client", message(0).ID)
+				checkpoint := wal.checkpoint()
+				wal.logMessage(message(1))
+				return &snapshot{NextSegment: checkpoint.segment, Messages: []MessageFull{message(0)}, Clients: checkpoint.clients}
+			},
+			wantMessages: []MessageFull{message(0), message(1)},
+			wantSeen:     VectorClock{"a": 0},
+			wantSegments: []int{1, 2},
+		},
+		{
+			name: "compacted history",
+			write: func(wal *writeAheadLog) *snapshot {
+				wal.logMessage(message(0))
+				checkpoint := wal.checkpoint()
+				wal.logMessage(message(1))
+				return &snapshot{NextSegment: checkpoint.segment, Compacted: VectorClock{"a": 0}}
+			},
+			wantMessages:  []MessageFull{message(1)},
+			wantCompacted: VectorClock{"a": 0},
+			wantSeen:      VectorClock{},
+			wantSegments:  []int{1, 2},
+		},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "test.wal")
+			wal, err := openWriteAheadLog(path, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			snap := tc.write(wal)
+
+			var intact int64
+			if tc.torn {
+				segments, _ := wal.segments()
+				last := wal.segmentPath(segments[len(segments)-1])
+				info, err := os.Stat(last)
+				if err != nil {
+					t.Fatal(err)
+				}
+				intact = info.Size()
+				file, err := os.OpenFile(last, os.O_WRONLY|os.O_APPEND, 0644)
+				if err != nil {
+					t.Fatal(err)
+				}
+				file.WriteString(`{"Message":{"ID":{"Host":"a","Cl`)
+				file.Close()
+			}
+
+			reopened, err := openWriteAheadLog(path, snap)
+			if err != nil {
+				t.Fatal(err)
+			}
+			messages, compacted := reopened.recoveredHistory()
+			if len(messages) != len(tc.wantMessages) {
+				t.Fatalf("recovered %d messages, want %d", len(messages), len(tc.wantMessages))
+			}
+			for i, want := range tc.wantMessages {
+				if messages[i].ID != want.ID || string(messages[i].Body) != string(want.Body) {
+					t.Errorf("message %d: got %s, want %s", i, messages[i].ID.ToString(), want.ID.ToString())
+				}
+			}
+			if compacted.ToString() != tc.wantCompacted.ToString() {
+				t.Errorf("compacted %s, want %s", compacted.ToString(), tc.wantCompacted.ToString())
+			}
+			if seen := reopened.clientState("client"); seen.ToString() != tc.wantSeen.ToString() {
+				t.Errorf("the client has seen %s, want %s", seen.ToString(), tc.wantSeen.ToString())
+			}
+			segments, err := reopened.segments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(segments, tc.wantSegments) {
+				t.Errorf("segments %v on disk, want %v", segments, tc.wantSegments)
+			}
+			if tc.torn {
+				info, err := os.Stat(reopened.segmentPath(0))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if info.Size() != intact {
+					t.Errorf("the torn segment is %d bytes, want %d", info.Size(), intact)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,243 @@
+// Package wire is the protocol clients and datacenters speak, to each other and among
+// themselves. Everything is sent in frames: a 4 byte big endian length, a byte with the
+// type of the frame, and that many bytes of payload (text or JSON, depending on the
+// type), so payloads may hold anything, newlines included.
+//
+// Every connection starts with a handshake. The side that dials sends a Hello with the
+// range of versions it speaks and what it is (a client, a datacenter link...), the
+// other side answers with a Welcome and the highest version both speak, or with a
+// Refused and the versions it speaks when there is none
+package wire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+)
+
+// The versions of the protocol this side speaks
+const (
+	MinVersion = 1
+	Version    = 1
+)
+
+// Frames bigger than this are refused, a peer that sends one is broken (or doesn't
+// speak the protocol at all, the first bytes of a text line make a huge length)
+const MaxFrameSize = 64 << 20
+
+// Starts the payload of every Hello, so that something else connecting is told apart
+// from a peer with an incompatible version
+const magic = "causal"
+
+// What a frame holds. The numbers are part of the protocol, new types only ever go at
+// the end
+type Type byte
+
+const (
+	// The handshake: "<magic><min version><max version><endpoint>", the version
+	// picked, and "<min version><max version>" spoken when refusing. Versions are
+	// always 2 bytes, big endian
+	Hello Type = iota + 1
+	Welcome
+	Refused
+
+	// Client to datacenter: "<client id> <last clock> [<session token>]", the session
+	// guarantees it asks for, and whatever the user typed
+	Identity
+	Guarantees
+	Command
+
+	// Datacenter to client. A message that causally follows everything the client has
+	// already shown, one that is concurrent with something the client has shown
+	// (possibly one of its own, its sender had not seen that yet), the answer to one of
+	// the client's reads (or some news), the clock of the last message the client sent
+	// (a line usually uses up one clock, but transactions use one per write), one of
+	// the client's commands failing, and the client's session token (what it has seen
+	// and written, as JSON, which it brings along when it fails over)
+	Causal
+	Concurrent
+	Value
+	Clock
+	Failure
+	Session
+
+	// Between datacenters, all JSON but Ack. The introduction of a datacenter, a
+	// packet on a link, the number of the last packet received, an anti-entropy digest,
+	// and what a datacenter that joins gets back
+	Introduce
+	Packet
+	Ack
+	Digest
+	JoinReply
+)
+
+var typeNames = map[Type]string{
+	Hello: "hello", Welcome: "welcome", Refused: "refused",
+	Identity: "identity", Guarantees: "guarantees", Command: "command",
+	Causal: "causal", Concurrent: "concurrent", Value: "value", Clock: "clock", Failure: "failure", Session: "session",
+	Introduce: "introduce", Packet: "packet", Ack: "ack", Digest: "digest", JoinReply: "join reply",
+}
+
+func (kind Type) String() string {
+	if name, found := typeNames[kind]; found {
+		return name
+	}
+	return fmt.Sprint("unknown (", byte(kind), ")")
+}
+
+// Writes a frame and flushes it
+func WriteFrame(writer *bufio.Writer, kind Type, payload []byte) error {
+	if len(payload) > MaxFrameSize {
+		return fmt.Errorf("%s frame of %d bytes is too big", kind, len(payload))
+	}
+	header := make([]byte, 5)
+	binary.BigEndian.PutUint32(header, uint32(len(payload)))
+	header[4] = byte(kind)
+	if _, err := writer.Write(header); err != nil {
+		return err
+	}
+	if _, err := writer.Write(payload); err != nil {
+		return err
+	}
+	return writer.Flush()
+}
+
+// Reads the next frame
+func ReadFrame(reader *bufio.Reader) (Type, []byte, error) {
+	header := make([]byte, 5)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, nil, err
+	}
+	size := binary.BigEndian.Uint32(header)
+	if size > MaxFrameSize {
+		return 0, nil, fmt.Errorf("frame of %d bytes is too big", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return 0, nil, err
+	}
+	return Type(header[4]), payload, nil
+}
+
+// Reads the next frame, which has to be of the given type
+func Expect(reader *bufio.Reader, kind Type) ([]byte, error) {
+	got, payload, err := ReadFrame(reader)
+	if err != nil {
+		return nil, err
+	}
+	if got != kind {
+		return nil, fmt.Errorf("expected a %s frame, got a %s frame", kind, got)
+	}
+	return payload, nil
+}
+
+// Writes a frame with v encoded as JSON
+func WriteJSON(writer *bufio.Writer, kind Type, v interface{}) error {
+	encoded, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return WriteFrame(writer, kind, encoded)
+}
+
+// Reads a frame of the given type into v, which it holds as JSON
+func ReadJSON(reader *bufio.Reader, kind Type, v interface{}) error {
+	payload, err := Expect(reader, kind)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(payload, v)
+}
+
+// A peer that doesn't speak any version this side speaks
+type IncompatibleError struct {
+	// The versions the peer speaks
+	Min, Max int
+}
+
+func (err *IncompatibleError) Error() string {
+	return fmt.Sprintf("incompatible protocol: the peer speaks %s, this side speaks %s", versionRange(err.Min, err.Max), versionRange(MinVersion, Version))
+}
+
+func versionRange(min int, max int) string {
+	if min == max {
+		return fmt.Sprint("version ", min)
+	}
+	return fmt.Sprint("versions ", min, " to ", max)
+}
+
+// Encodes a version as it goes in a handshake frame
+func encodeVersion(version int) []byte {
+	encoded := make([]byte, 2)
+	binary.BigEndian.PutUint16(encoded, uint16(version))
+	return encoded
+}
+
+// The versions from min to max, as they go in a Hello or Refused
+func encodeVersions(min int, max int) []byte {
+	return append(encodeVersion(min), encodeVersion(max)...)
+}
+
+// Decodes the versions at the start of payload, which holds at least 4 bytes
+func decodeVersions(payload []byte) (int, int) {
+	return int(binary.BigEndian.Uint16(payload)), int(binary.BigEndian.Uint16(payload[2:]))
+}
+
+// The dialing side of the handshake, says it is an endpoint. Returns the version the
+// other side picked, a peer that refuses gives an *IncompatibleError
+func Handshake(reader *bufio.Reader, writer *bufio.Writer, endpoint string) (int, error) {
+	hello := append([]byte(magic), encodeVersions(MinVersion, Version)...)
+	if err := WriteFrame(writer, Hello, append(hello, endpoint...)); err != nil {
+		return 0, err
+	}
+	kind, payload, err := ReadFrame(reader)
+	if err != nil {
+		return 0, err
+	}
+	switch kind {
+	case Welcome:
+		if len(payload) != 2 {
+			return 0, fmt.Errorf("bad welcome %q", payload)
+		}
+		version := int(binary.BigEndian.Uint16(payload))
+		if version < MinVersion || version > Version {
+			return 0, fmt.Errorf("the peer picked protocol version %d, this side speaks %s", version, versionRange(MinVersion, Version))
+		}
+		return version, nil
+	case Refused:
+		if len(payload) != 4 {
+			return 0, fmt.Errorf("bad refusal %q", payload)
+		}
+		min, max := decodeVersions(payload)
+		return 0, &IncompatibleError{Min: min, Max: max}
+	}
+	return 0, fmt.Errorf("expected a welcome frame, got a %s frame", kind)
+}
+
+// The accepting side of the handshake. Returns what the other side is and the version
+// picked. A peer with no version in common is refused and an *IncompatibleError
+// returned
+func AcceptHandshake(reader *bufio.Reader, writer *bufio.Writer) (string, int, error) {
+	payload, err := Expect(reader, Hello)
+	if err != nil {
+		return "", 0, fmt.Errorf("not speaking the protocol: %w", err)
+	}
+	if len(payload) < len(magic)+4 || !strings.HasPrefix(string(payload), magic) {
+		return "", 0, fmt.Errorf("not speaking the protocol: bad hello %q", payload)
+	}
+	min, max := decodeVersions(payload[len(magic):])
+	endpoint := string(payload[len(magic)+4:])
+	version := max
+	if version > Version {
+		version = Version
+	}
+	if version < min || version < MinVersion {
+		err := &IncompatibleError{Min: min, Max: max}
+		WriteFrame(writer, Refused, encodeVersions(MinVersion, Version))
+		return endpoint, 0, err
+	}
+	return endpoint, version, WriteFrame(writer, Welcome, encodeVersion(version))
+}
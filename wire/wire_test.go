@@ -0,0 +1,211 @@
+package wire
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"testing"
+)
+
+func TestFrames(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		kind    Type
+		payload []byte
+	}{
+		{name: "empty", kind: Command, payload: []byte{}},
+		{name: "text", kind: Command, payload: []byte("hello there")},
+		{name: "newlines", kind: Causal, payload: []byte("one\ntwo\r\nthree\n")},
+		{name: "binary", kind: Packet, payload: []byte{0, 1, 2, 255, '\n', 0}},
+		{name: "large", kind: Packet, payload: bytes.Repeat([]byte("x"), 1<<20)},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			if err := WriteFrame(bufio.NewWriter(&buffer), tc.kind, tc.payload); err != nil {
+				t.Fatal(err)
+			}
+			if buffer.Len() != 5+len(tc.payload) {
+				t.Fatalf("frame of %d bytes, want %d", buffer.Len(), 5+len(tc.payload))
+			}
+			kind, payload, err := ReadFrame(bufio.NewReader(&buffer))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if kind != tc.kind || !bytes.Equal(payload, tc.payload) {
+				t.Fatalf("got a %s frame of %d bytes, want a %s frame of %d bytes", kind, len(payload), tc.kind, len(tc.payload))
+			}
+		})
+	}
+}
+
+func TestBadFrames(t *testing.T) {
+	header := func(size uint32, kind Type) []byte {
+		encoded := make([]byte, 5)
+		binary.BigEndian.PutUint32(encoded, size)
+		encoded[4] = byte(kind)
+		return encoded
+	}
+	for _, tc := range []struct {
+		name  string
+		input []byte
+	}{
+		{name: "nothing", input: nil},
+		{name: "short header", input: []byte{0, 0, 1}},
+		{name: "short payload", input: append(header(10, Command), "short"...)},
+		{name: "too big", input: header(MaxFrameSize+1, Command)},
+		// What a peer sending lines of text looks like
+		{name: "text line", input: []byte("hello there\r\n")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			if _, _, err := ReadFrame(bufio.NewReader(bytes.NewReader(tc.input))); err == nil {
+				t.Fatal("read a frame, want an error")
+			}
+		})
+	}
+
+	t.Run("too big to write", func(t *testing.T) {
+		var buffer bytes.Buffer
+		if err := WriteFrame(bufio.NewWriter(&buffer), Packet, make([]byte, MaxFrameSize+1)); err == nil {
+			t.Fatal("wrote the frame, want an error")
+		}
+		if buffer.Len() != 0 {
+			t.Fatalf("wrote %d bytes of a frame that is too big", buffer.Len())
+		}
+	})
+
+	t.Run("unexpected type", func(t *testing.T) {
+		var buffer bytes.Buffer
+		WriteFrame(bufio.NewWriter(&buffer), Command, []byte("hi"))
+		if _, err := Expect(bufio.NewReader(&buffer), Identity); err == nil {
+			t.Fatal("accepted a command frame for an identity frame")
+		}
+	})
+}
+
+func TestHandshake(t *testing.T) {
+	t.Run("both sides", func(t *testing.T) {
+		dialing, accepting := net.Pipe()
+		defer dialing.Close()
+		defer accepting.Close()
+		dialed := make(chan error, 1)
+		go func() {
+			version, err := Handshake(bufio.NewReader(dialing), bufio.NewWriter(dialing), "client")
+			if err == nil && version != Version {
+				err = fmt.Errorf("the dialing side got version %d, want %d", version, Version)
+			}
+			dialed <- err
+		}()
+		endpoint, version, err := AcceptHandshake(bufio.NewReader(accepting), bufio.NewWriter(accepting))
+		if err != nil || endpoint != "client" || version != Version {
+			t.Fatalf("accepted %q with version %d (%v), want %q with version %d", endpoint, version, err, "client", Version)
+		}
+		if err := <-dialed; err != nil {
+			t.Fatal(err)
+		}
+	})
+
+	hello := func(min int, max int, endpoint string) []byte {
+		return append(append([]byte(magic), encodeVersions(min, max)...), endpoint...)
+	}
+	for _, tc := range []struct {
+		name     string
+		hello    []byte
+		endpoint string
+		version  int
+		// The error AcceptHandshake returns: none, an *IncompatibleError, or another
+		// one (something that doesn't speak the protocol at all)
+		incompatible bool
+		bad          bool
+	}{
+		{name: "same versions", hello: hello(MinVersion, Version, "client"), endpoint: "client", version: Version},
+		{name: "newer peer", hello: hello(MinVersion, Version+3, "link"), endpoint: "link", version: Version},
+		{name: "only newer versions", hello: hello(Version+1, Version+2, "link"), endpoint: "link", incompatible: true},
+		{name: "only older versions", hello: hello(0, MinVersion-1, "link"), endpoint: "link", incompatible: true},
+		{name: "no endpoint", hello: hello(MinVersion, Version, ""), version: Version},
+		{name: "no magic", hello: append([]byte("casual"), encodeVersions(MinVersion, Version)...), bad: true},
+		{name: "short", hello: []byte(magic + "\x00"), bad: true},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var in, out bytes.Buffer
+			WriteFrame(bufio.NewWriter(&in), Hello, tc.hello)
+			endpoint, version, err := AcceptHandshake(bufio.NewReader(&in), bufio.NewWriter(&out))
+
+			var incompatible *IncompatibleError
+			switch {
+			case tc.bad:
+				if err == nil || errors.As(err, &incompatible) {
+					t.Fatalf("got %v, want an error for not speaking the protocol", err)
+				}
+				return
+			case tc.incompatible:
+				if !errors.As(err, &incompatible) {
+					t.Fatalf("got %v, want an *IncompatibleError", err)
+				}
+				if _, err := Expect(bufio.NewReader(&out), Refused); err != nil {
+					t.Fatalf("the peer wasn't refused: %v", err)
+				}
+				return
+			case err != nil:
+				t.Fatal(err)
+			}
+			if endpoint != tc.endpoint || version != tc.version {
+				t.Fatalf("got endpoint %q with version %d, want %q with version %d", endpoint, version, tc.endpoint, tc.version)
+			}
+			if _, err := Expect(bufio.NewReader(&out), Welcome); err != nil {
+				t.Fatalf("the peer wasn't welcomed: %v", err)
+			}
+		})
+	}
+}
+
+// The dialing side reads whatever the accepting side answered
+func TestHandshakeAnswers(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		kind    Type
+		payload []byte
+		version int
+		// Whether the handshake fails because the peer refused
+		refused bool
+	}{
+		{name: "welcome", kind: Welcome, payload: encodeVersion(Version), version: Version},
+		{name: "welcome to a version never offered", kind: Welcome, payload: encodeVersion(Version + 1)},
+		{name: "welcome as text", kind: Welcome, payload: []byte("1")},
+		{name: "refused", kind: Refused, payload: encodeVersions(Version+1, Version+2), refused: true},
+		{name: "bad refusal", kind: Refused, payload: []byte("versions 2 to 3")},
+		{name: "something else", kind: Command, payload: []byte("hello")},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var in, out bytes.Buffer
+			WriteFrame(bufio.NewWriter(&in), tc.kind, tc.payload)
+			version, err := Handshake(bufio.NewReader(&in), bufio.NewWriter(&out), "client")
+
+			payload, helloErr := Expect(bufio.NewReader(&out), Hello)
+			if helloErr != nil || !strings.HasPrefix(string(payload), magic) || !strings.HasSuffix(string(payload), "client") {
+				t.Fatalf("sent hello %q (%v)", payload, helloErr)
+			}
+			var incompatible *IncompatibleError
+			switch {
+			case tc.refused:
+				if !errors.As(err, &incompatible) {
+					t.Fatalf("got %v, want an *IncompatibleError", err)
+				}
+				if incompatible.Min != Version+1 || incompatible.Max != Version+2 {
+					t.Fatalf("the peer speaks versions %d to %d, want %d to %d", incompatible.Min, incompatible.Max, Version+1, Version+2)
+				}
+			case tc.version == 0:
+				if err == nil {
+					t.Fatalf("picked version %d, want an error", version)
+				}
+			case err != nil:
+				t.Fatal(err)
+			case version != tc.version:
+				t.Fatalf("got version %d, want %d", version, tc.version)
+			}
+		})
+	}
+}